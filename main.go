@@ -1,11 +1,44 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/packer/plugin"
 	"github.com/podpolkovnick/packer-post-processor-shell/shell"
 )
 
+// The range of Packer plugin API versions this post-processor supports.
+// Packer refuses plugins speaking another version than its own, so this
+// catches building against an incompatible Packer before it gets there.
+const (
+	minAPIVersion = 4
+	maxAPIVersion = 4
+)
+
 func main() {
+	// "validate <config.json>" (or "--config-check <config.json>")
+	// checks a post-processor configuration without Packer, for use in
+	// editors and CI.
+	if len(os.Args) == 3 && (os.Args[1] == "validate" || os.Args[1] == "--config-check") {
+		os.Exit(validate(os.Args[2]))
+	}
+
+	if err := checkAPIVersion(plugin.APIVersion); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Don't let a closed stdout or stderr kill the plugin while scripts
+	// are running; writes will fail with EPIPE instead.
+	signal.Ignore(syscall.SIGPIPE)
+
 	server, err := plugin.Server()
 	if err != nil {
 		panic(err)
@@ -13,3 +46,52 @@ func main() {
 	server.RegisterPostProcessor(new(shell.PostProcessor))
 	server.Serve()
 }
+
+// checkAPIVersion verifies that the given plugin API version, that of the
+// Packer this plugin was built against, is one it supports.
+func checkAPIVersion(version string) error {
+	v, err := strconv.Atoi(version)
+	if err != nil || v < minAPIVersion || v > maxAPIVersion {
+		return fmt.Errorf(
+			"This post-processor supports Packer plugin API versions %d to %d, "+
+				"but was built with version %s. Rebuild it against a compatible "+
+				"version of Packer.", minAPIVersion, maxAPIVersion, version)
+	}
+
+	return nil
+}
+
+// validate configures the post-processor with the JSON object in the
+// given file, as it would appear in the post-processors section of a
+// template, and reports any errors. It returns the exit status.
+func validate(path string) int {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading config: %s\n", err)
+		return 1
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(contents, &raw); err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing config: %s\n", err)
+		return 1
+	}
+
+	// The type only tells Packer which plugin to use
+	delete(raw, "type")
+
+	if err := new(shell.PostProcessor).Configure(raw); err != nil {
+		fmt.Fprintln(os.Stderr, "Configuration is invalid:")
+		if merr, ok := err.(*packer.MultiError); ok {
+			for _, err := range merr.Errors {
+				fmt.Fprintf(os.Stderr, "  * %s\n", err)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "  * %s\n", err)
+		}
+		return 1
+	}
+
+	fmt.Println("Configuration is valid.")
+	return 0
+}
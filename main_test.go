@@ -1,3 +1,28 @@
 package main
 
-// This will simply test compilation
+import (
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/packer/packer/plugin"
+)
+
+func TestCheckAPIVersion(t *testing.T) {
+	cases := map[string]bool{
+		plugin.APIVersion: true,
+		"3":               false,
+		"5":               false,
+		"":                false,
+		"x":               false,
+	}
+
+	for version, ok := range cases {
+		err := checkAPIVersion(version)
+		if ok && err != nil {
+			t.Fatalf("%q: err: %s", version, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "supports Packer plugin API versions 4 to 4")) {
+			t.Fatalf("%q: bad: %v", version, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+const BuilderId = "packer.post-processor.shell"
+
+// localArtifact is the artifact returned by every feature that produces
+// output. It either holds new files the scripts produced, or wraps the
+// input artifact to attach extra state to it.
+//
+// Destroy follows ownership: an artifact with its own files removes them,
+// while a wrapper with no files of its own destroys the input artifact.
+// A wrapper therefore takes over the input, and must be returned from
+// PostProcess with keep set to true so Packer doesn't destroy the input
+// a second time. An artifact with its own files leaves the input alone,
+// so keep_input_artifact decides the input's fate as usual. One with both
+// supplements the input with new files, and owns them all.
+type localArtifact struct {
+	files []string
+	input packer.Artifact
+	state map[string]interface{}
+}
+
+// newFilesArtifact returns an artifact made of files the scripts produced.
+func newFilesArtifact(files []string, state map[string]interface{}) *localArtifact {
+	return &localArtifact{files: files, state: state}
+}
+
+// wrapArtifact returns an artifact that stands in for the input one,
+// adding the given state on top of the input's.
+func wrapArtifact(input packer.Artifact, state map[string]interface{}) *localArtifact {
+	return &localArtifact{input: input, state: state}
+}
+
+// supplementArtifact returns an artifact that stands in for the input
+// one with the files the scripts produced added to the input's.
+func supplementArtifact(input packer.Artifact, files []string) *localArtifact {
+	return &localArtifact{files: files, input: input}
+}
+
+func (a *localArtifact) BuilderId() string {
+	if a.input != nil {
+		return a.input.BuilderId()
+	}
+	return BuilderId
+}
+
+func (a *localArtifact) Files() []string {
+	if a.input != nil {
+		files := append([]string(nil), a.input.Files()...)
+		return append(files, a.files...)
+	}
+	return a.files
+}
+
+func (a *localArtifact) Id() string {
+	if a.input != nil {
+		return a.input.Id()
+	}
+	return ""
+}
+
+func (a *localArtifact) String() string {
+	if a.input != nil && len(a.files) > 0 {
+		return fmt.Sprintf("%s, plus shell post-processor output: %s",
+			a.input.String(), strings.Join(a.files, ", "))
+	}
+	if a.input != nil {
+		return a.input.String()
+	}
+	return fmt.Sprintf("Shell post-processor output: %s", strings.Join(a.files, ", "))
+}
+
+func (a *localArtifact) State(name string) interface{} {
+	if v, ok := a.state[name]; ok {
+		return v
+	}
+	if a.input != nil {
+		return a.input.State(name)
+	}
+	return nil
+}
+
+func (a *localArtifact) Destroy() error {
+	var errs *packer.MultiError
+	if a.input != nil {
+		if err := a.input.Destroy(); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	for _, f := range a.files {
+		if err := os.RemoveAll(f); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+func TestLocalArtifact_Impl(t *testing.T) {
+	var raw interface{}
+	raw = &localArtifact{}
+	if _, ok := raw.(packer.Artifact); !ok {
+		t.Fatalf("must be an artifact")
+	}
+}
+
+func TestLocalArtifactDestroy_files(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		testScript(t, dir, "a.sig", ""),
+		testScript(t, dir, "b.sig", ""),
+	}
+	a := newFilesArtifact(files, map[string]interface{}{"url": "x"})
+	if a.BuilderId() != BuilderId || a.State("url") != "x" {
+		t.Fatalf("bad: %#v", a)
+	}
+
+	if err := a.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("not removed: %s", f)
+		}
+	}
+}
+
+func TestLocalArtifactDestroy_wrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := testScript(t, dir, "disk.img", "")
+	input := &testArtifact{
+		id:    "input",
+		files: []string{file},
+		state: map[string]interface{}{"url": "input", "region": "eu"},
+	}
+	a := wrapArtifact(input, map[string]interface{}{"url": "wrapped"})
+	if a.Id() != "input" || a.State("url") != "wrapped" || a.State("region") != "eu" {
+		t.Fatalf("bad: %#v", a)
+	}
+
+	// The input's files are the input's to remove
+	if err := a.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !input.destroyed {
+		t.Fatal("input not destroyed")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestLocalArtifactDestroy_supplement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := &testArtifact{files: []string{filepath.Join(dir, "disk.img")}}
+	sig := testScript(t, dir, "disk.img.sig", "")
+	a := supplementArtifact(input, []string{sig})
+	if files := a.Files(); len(files) != 2 || files[1] != sig {
+		t.Fatalf("bad: %#v", files)
+	}
+
+	if err := a.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !input.destroyed {
+		t.Fatal("input not destroyed")
+	}
+	if _, err := os.Stat(sig); !os.IsNotExist(err) {
+		t.Fatalf("not removed: %s", sig)
+	}
+}
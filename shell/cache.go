@@ -0,0 +1,87 @@
+package shell
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// defaultCacheDir is where skip_if_unchanged records successful runs
+// unless cache_dir says otherwise: under Packer's own cache directory.
+func defaultCacheDir() string {
+	dir := os.Getenv("PACKER_CACHE_DIR")
+	if dir == "" {
+		dir = "packer_cache"
+	}
+	return filepath.Join(dir, "shell")
+}
+
+// runKey returns what skip_if_unchanged compares to tell whether a run
+// would do the same as an earlier one: a hash of the artifact's id and
+// files, the scripts' contents and settings, and the environment
+// variables configured for them. Artifact files are compared according
+// to change_detection; directories only by path.
+func (p *PostProcessor) runKey(artifact packer.Artifact, scripts []ScriptConfig, vars []string, files []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "artifact %q %q\n", artifact.BuilderId(), artifact.Id())
+
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+
+		fingerprint := "directory"
+		if !fi.IsDir() {
+			fingerprint, err = changeDetectors[p.config.ChangeDetection].Fingerprint(file, fi)
+			if err != nil {
+				return "", err
+			}
+		}
+		fmt.Fprintf(h, "file %q %s\n", file, fingerprint)
+	}
+
+	for _, script := range scripts {
+		sum, err := fileChecksum(script.Path, sha256.New())
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "script %s %q %q %q %v\n", sum, script.Vars, script.WorkingDirectory,
+			script.RawTimeout, script.ValidExitCodes)
+	}
+
+	fmt.Fprintf(h, "execute_command %q %q %q\n", p.config.ExecuteCommand, p.config.Interpreter, p.config.ScriptArgs)
+	for _, kv := range vars {
+		fmt.Fprintf(h, "var %q\n", kv)
+	}
+	for _, entry := range p.config.Matrix {
+		fmt.Fprintf(h, "matrix %q %q\n", entry.Name, entry.Vars)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ranUnchanged reports whether a successful run with the given key was
+// recorded in cache_dir.
+func (p *PostProcessor) ranUnchanged(key string) bool {
+	_, err := os.Stat(filepath.Join(p.config.CacheDir, key))
+	return err == nil
+}
+
+// recordRun records a successful run with the given key in cache_dir.
+func (p *PostProcessor) recordRun(key string) error {
+	if err := os.MkdirAll(p.config.CacheDir, 0755); err != nil {
+		return err
+	}
+
+	log.Printf("Recording successful run: %s", key)
+	contents := fmt.Sprintf("%s %s\n", time.Now().UTC().Format(time.RFC3339), p.config.PackerBuildName)
+	return ioutil.WriteFile(filepath.Join(p.config.CacheDir, key), []byte(contents), 0644)
+}
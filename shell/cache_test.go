@@ -0,0 +1,207 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostProcessorConfigure_skipIfUnchangedOutput(t *testing.T) {
+	cases := map[string]interface{}{
+		"output":           "out",
+		"package":          "tar.gz",
+		"discard_artifact": true,
+	}
+
+	for key, value := range cases {
+		config := testConfig(t)
+		config["skip_if_unchanged"] = true
+		config[key] = value
+
+		var p PostProcessor
+		err := p.Configure(config)
+		if err == nil || !strings.Contains(err.Error(), "skip_if_unchanged can't be combined") {
+			t.Fatalf("%s: should error: %v", key, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_skipIfUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "log")
+	config := map[string]interface{}{
+		"script":            testLogScript(t, dir, "script.sh", log, 0),
+		"skip_if_unchanged": true,
+		"cache_dir":         filepath.Join(dir, "cache"),
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	artifact := &testArtifact{id: "a", files: []string{testScript(t, dir, "disk.img", "")}}
+	for i := 0; i < 2; i++ {
+		result, keep, err := p.PostProcess(new(testUi), artifact)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if result != artifact || keep {
+			t.Fatalf("%d: bad: %#v %t", i, result, keep)
+		}
+	}
+
+	if ran := testReadLog(t, log); len(ran) != 1 {
+		t.Fatalf("bad: %v", ran)
+	}
+}
+
+func TestPostProcessorPostProcess_skipIfUnchangedProduced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The artifact the script makes must be made every time
+	log := filepath.Join(dir, "log")
+	produced := testScript(t, dir, "produced.img", "")
+	script := testScript(t, dir, "script.sh",
+		"#!/bin/sh\necho ran >> '"+log+"'\necho '"+produced+"' > \"$PACKER_RESULT_FILE\"\n")
+	config := map[string]interface{}{
+		"script":            script,
+		"skip_if_unchanged": true,
+		"cache_dir":         filepath.Join(dir, "cache"),
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	artifact := &testArtifact{id: "a", files: []string{testScript(t, dir, "disk.img", "")}}
+	for i := 0; i < 2; i++ {
+		result, _, err := p.PostProcess(new(testUi), artifact)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		files := result.Files()
+		if len(files) != 1 || files[0] != produced {
+			t.Fatalf("%d: bad: %#v", i, files)
+		}
+	}
+
+	if ran := testReadLog(t, log); len(ran) != 2 {
+		t.Fatalf("bad: %v", ran)
+	}
+}
+
+func TestPostProcessorRunKey_changeDetection(t *testing.T) {
+	// A rewrite keeping the length and the modification time is only
+	// noticed by hashing
+	cases := map[string]bool{
+		"hash":  true,
+		"mtime": false,
+		"size":  false,
+	}
+
+	for mode, changed := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		config := testConfig(t)
+		config["change_detection"] = mode
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		old := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+		file := testScript(t, dir, "disk.img", "aaaa")
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		artifact := &testArtifact{id: "a", files: []string{file}}
+		before, err := p.runKey(artifact, nil, nil, artifact.files)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		testScript(t, dir, "disk.img", "bbbb")
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		after, err := p.runKey(artifact, nil, nil, artifact.files)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if (before != after) != changed {
+			t.Fatalf("%s: bad: %s %s", mode, before, after)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_skipIfUnchangedDetection(t *testing.T) {
+	// Each changes the file in a way the mode notices
+	cases := map[string]func(path string) error{
+		"hash": func(path string) error {
+			return ioutil.WriteFile(path, []byte("bbbb"), 0644)
+		},
+		"mtime": func(path string) error {
+			later := time.Now().Add(time.Hour)
+			return os.Chtimes(path, later, later)
+		},
+		"size": func(path string) error {
+			return ioutil.WriteFile(path, []byte("aaaab"), 0644)
+		},
+	}
+
+	for mode, change := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		log := filepath.Join(dir, "log")
+		config := map[string]interface{}{
+			"script":            testLogScript(t, dir, "script.sh", log, 0),
+			"skip_if_unchanged": true,
+			"change_detection":  mode,
+			"cache_dir":         filepath.Join(dir, "cache"),
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		artifact := &testArtifact{id: "a", files: []string{testScript(t, dir, "disk.img", "aaaa")}}
+		for i := 0; i < 3; i++ {
+			if i == 2 {
+				if err := change(artifact.files[0]); err != nil {
+					t.Fatalf("err: %s", err)
+				}
+			}
+			if _, _, err := p.PostProcess(new(testUi), artifact); err != nil {
+				t.Fatalf("%s: err: %s", mode, err)
+			}
+		}
+
+		if ran := testReadLog(t, log); len(ran) != 2 {
+			t.Fatalf("%s: bad: %v", mode, ran)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package shell
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"time"
+)
+
+// changeDetector decides whether an artifact file changed by comparing
+// fingerprints taken before and after: the file changed if they differ.
+type changeDetector interface {
+	Fingerprint(path string, fi os.FileInfo) (string, error)
+}
+
+// changeDetectors are the supported change_detection modes by name.
+var changeDetectors = map[string]changeDetector{
+	"hash":  hashDetector{},
+	"mtime": mtimeDetector{},
+	"size":  sizeDetector{},
+}
+
+// hashDetector compares the SHA256 of the contents. It is the slowest
+// but the only one that can't miss a change.
+type hashDetector struct{}
+
+func (hashDetector) Fingerprint(path string, fi os.FileInfo) (string, error) {
+	return fileChecksum(path, sha256.New())
+}
+
+// mtimeDetector compares the modification time.
+type mtimeDetector struct{}
+
+func (mtimeDetector) Fingerprint(path string, fi os.FileInfo) (string, error) {
+	return fi.ModTime().UTC().Format(time.RFC3339Nano), nil
+}
+
+// sizeDetector compares the size, which is cheapest but misses changes
+// that keep the size the same.
+type sizeDetector struct{}
+
+func (sizeDetector) Fingerprint(path string, fi os.FileInfo) (string, error) {
+	return fmt.Sprintf("%d", fi.Size()), nil
+}
@@ -0,0 +1,93 @@
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChangeDetectors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		change  func(path string) error
+		changed map[string]bool
+	}{
+		{
+			"unchanged",
+			func(path string) error { return nil },
+			map[string]bool{"hash": false, "mtime": false, "size": false},
+		},
+		{
+			"same length",
+			func(path string) error {
+				if err := ioutil.WriteFile(path, []byte("bbbb"), 0644); err != nil {
+					return err
+				}
+				return os.Chtimes(path, old, old)
+			},
+			// Only the contents tell
+			map[string]bool{"hash": true, "mtime": false, "size": false},
+		},
+		{
+			"touched",
+			func(path string) error {
+				now := time.Now()
+				return os.Chtimes(path, now, now)
+			},
+			map[string]bool{"hash": false, "mtime": true, "size": false},
+		},
+		{
+			"appended",
+			func(path string) error {
+				if err := ioutil.WriteFile(path, []byte("aaaab"), 0644); err != nil {
+					return err
+				}
+				return os.Chtimes(path, old, old)
+			},
+			map[string]bool{"hash": true, "mtime": false, "size": true},
+		},
+	}
+
+	for _, tc := range cases {
+		for mode, changed := range tc.changed {
+			path := filepath.Join(dir, "disk.img")
+			if err := ioutil.WriteFile(path, []byte("aaaa"), 0644); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			before := testFingerprint(t, mode, path)
+			if err := tc.change(path); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			after := testFingerprint(t, mode, path)
+
+			if (before != after) != changed {
+				t.Fatalf("%s %s: bad: %q %q", tc.name, mode, before, after)
+			}
+		}
+	}
+}
+
+func testFingerprint(t *testing.T, mode string, path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	fingerprint, err := changeDetectors[mode].Fingerprint(path, fi)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return fingerprint
+}
@@ -0,0 +1,75 @@
+package shell
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checksumTypes are the supported checksum algorithms by name.
+var checksumTypes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// fileChecksum returns the hex encoded checksum of the file's contents,
+// streaming it through the hash rather than reading it all at once.
+func fileChecksum(path string, h hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// artifactChecksums computes every one of checksum_types of the artifact
+// file in a single pass, writing each next to it with checksum_file.
+func (p *PostProcessor) artifactChecksums(path string) (map[string]string, error) {
+	hashes := make([]hash.Hash, len(p.config.ChecksumTypes))
+	writers := make([]io.Writer, len(hashes))
+	for i, t := range p.config.ChecksumTypes {
+		hashes[i] = checksumTypes[t]()
+		writers[i] = hashes[i]
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string, len(hashes))
+	for i, t := range p.config.ChecksumTypes {
+		sums[t] = hex.EncodeToString(hashes[i].Sum(nil))
+		if !p.config.ChecksumFile {
+			continue
+		}
+
+		line := fmt.Sprintf("%s  %s\n", sums[t], filepath.Base(path))
+		if err := ioutil.WriteFile(path+"."+t, []byte(line), 0644); err != nil {
+			return nil, fmt.Errorf("Error writing checksum file: %s", err)
+		}
+	}
+
+	return sums, nil
+}
@@ -0,0 +1,92 @@
+package shell
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// maskedValue replaces secrets in anything shown outside of the scripts'
+// own environment.
+const maskedValue = "****"
+
+// configJSON returns the effective configuration as JSON, keyed by the
+// same names used in templates, with secrets masked.
+func (p *PostProcessor) configJSON() (string, error) {
+	m := templateValue(reflect.ValueOf(p.config)).(map[string]interface{})
+
+	if pipes, ok := m["secret_pipes"].(map[string]interface{}); ok {
+		for k := range pipes {
+			pipes[k] = maskedValue
+		}
+	}
+
+	if remote, ok := m["remote"].(map[string]interface{}); ok && remote["password"] != "" {
+		remote["password"] = maskedValue
+	}
+
+	out, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// templateValue converts a config value into plain maps and slices,
+// naming struct fields after their mapstructure tags. Unexported fields
+// are left out.
+func templateValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return templateValue(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		addStructFields(m, v)
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			s[i] = templateValue(v.Index(i))
+		}
+		return s
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{})
+		for _, k := range v.MapKeys() {
+			m[k.String()] = templateValue(v.MapIndex(k))
+		}
+		return m
+	default:
+		return v.Interface()
+	}
+}
+
+func addStructFields(m map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("mapstructure"), ",")
+		if len(tag) > 1 && tag[1] == "squash" {
+			addStructFields(m, v.Field(i))
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		m[name] = templateValue(v.Field(i))
+	}
+}
@@ -0,0 +1,10 @@
+package shell
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func setGroups(cmd *exec.Cmd, gids []uint32) error {
+	return errors.New("groups is not supported on Windows")
+}
@@ -0,0 +1,103 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerFileVars are the environment variables naming files the
+// post-processor shares with the scripts.
+var dockerFileVars = map[string]bool{
+	"PACKER_ARTIFACT_MANIFEST": true,
+	"PACKER_KEEP_ARTIFACT":     true,
+	"PACKER_RESULT_FILE":       true,
+	"PACKER_SHELL_ENV_FILE":    true,
+	"PACKER_STATE_FILE":        true,
+}
+
+// dockerCommand returns a command running execute_command for the script
+// and artifact file inside a new container of docker_image. The script,
+// the directories of the artifact files and the files shared with the
+// scripts are mounted at the same, absolute, paths they have on the host,
+// as the container doesn't start in the same directory.
+func (p *PostProcessor) dockerCommand(ctx context.Context, script string, art string, envVars []string) (*exec.Cmd, error) {
+	path, err := filepath.Abs(script)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving script %s: %s", script, err)
+	}
+	script = path
+
+	var files []string
+	envVars = append([]string(nil), envVars...)
+	for i, kv := range envVars {
+		vs := strings.SplitN(kv, "=", 2)
+		if vs[0] == "PACKER_ARTIFACT_FILES" && vs[1] != "" {
+			files = strings.Split(vs[1], "\n")
+		}
+		if dockerFileVars[vs[0]] && vs[1] != "" {
+			path, err := filepath.Abs(vs[1])
+			if err != nil {
+				return nil, fmt.Errorf("Error resolving %s: %s", vs[0], err)
+			}
+			envVars[i] = vs[0] + "=" + path
+		}
+	}
+
+	command, err := p.executeCommand(script, envVars, art)
+	if err != nil {
+		return nil, fmt.Errorf("Error processing execute_command: %s", err)
+	}
+
+	// The script isn't mounted read-only, since the default
+	// execute_command makes it executable first, as it does on the host.
+	args := []string{"run", "--rm", "-i", "-v", script + ":" + script}
+
+	// The artifact argument may be a batch of several files, and paths
+	// may have spaces, so the directories come from the list of files.
+	mounted := make(map[string]bool)
+	for _, file := range files {
+		dir, err := filepath.Abs(filepath.Dir(file))
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving artifact file %s: %s", file, err)
+		}
+		if !mounted[dir] {
+			mounted[dir] = true
+			args = append(args, "-v", dir+":"+dir)
+		}
+	}
+
+	if p.config.WorkingDirectory != "" {
+		dir, err := filepath.Abs(p.config.WorkingDirectory)
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving working_directory: %s", err)
+		}
+		args = append(args, "-v", dir+":"+dir, "-w", dir)
+	}
+
+	for _, volume := range p.config.DockerVolumes {
+		args = append(args, "-v", volume)
+	}
+
+	// Only the names are given, docker takes the values from its own
+	// environment, so they don't show up in the process list. The files
+	// passed to the scripts through them are mounted too, and given with
+	// their absolute paths, which aren't secret.
+	for _, kv := range envVars {
+		vs := strings.SplitN(kv, "=", 2)
+		if dockerFileVars[vs[0]] && vs[1] != "" {
+			args = append(args, "-e", kv, "-v", vs[1]+":"+vs[1])
+			continue
+		}
+		args = append(args, "-e", vs[0])
+	}
+
+	args = append(args, p.config.DockerRunArgs...)
+	args = append(args, p.config.DockerImage, "sh", "-c", command)
+
+	log.Printf("Executing shell command in %s: %s", p.config.DockerImage, command)
+	return exec.CommandContext(ctx, "docker", args...), nil
+}
@@ -0,0 +1,65 @@
+package shell
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPostProcessorDockerCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Configure only needs docker to be found
+	testScript(t, dir, "docker", "#!/bin/sh\n")
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := testConfig(t)
+	config["docker_image"] = "alpine"
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	art := filepath.Join(dir, "with space", "disk.img")
+	envVars := []string{
+		"PACKER_ARTIFACT_FILES=" + art + "\n" + filepath.Join(dir, "other", "disk.vmx"),
+		"PACKER_STATE_FILE=state.json",
+		"PACKER_BUILD_NAME=test",
+	}
+	cmd, err := p.dockerCommand(context.Background(), "script.sh", art, envVars)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	args := strings.Join(cmd.Args, "\x00")
+	expected := []string{
+		"-v\x00" + filepath.Join(wd, "script.sh") + ":" + filepath.Join(wd, "script.sh") + "\x00",
+		"-v\x00" + filepath.Join(dir, "with space") + ":" + filepath.Join(dir, "with space"),
+		"-v\x00" + filepath.Join(dir, "other") + ":" + filepath.Join(dir, "other"),
+		"-e\x00PACKER_STATE_FILE=" + filepath.Join(wd, "state.json") + "\x00-v\x00" +
+			filepath.Join(wd, "state.json") + ":" + filepath.Join(wd, "state.json"),
+		"-e\x00PACKER_BUILD_NAME\x00",
+	}
+	for _, e := range expected {
+		if !strings.Contains(args, e) {
+			t.Fatalf("missing %q in %q", e, cmd.Args)
+		}
+	}
+
+	// The artifact itself must not be split into mounts
+	if strings.Contains(args, "-v\x00"+dir+":") || strings.Contains(args, "-v\x00space") {
+		t.Fatalf("bad: %q", cmd.Args)
+	}
+}
@@ -0,0 +1,65 @@
+package shell
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// dryRun reports the command each script would be run with against each
+// target, along with the environment it would be given, without running
+// anything.
+func (p *PostProcessor) dryRun(ui packer.Ui, scripts []ScriptConfig, targets []string, envVars []string, inline string) error {
+	if inline != "" {
+		ui.Say(fmt.Sprintf("Dry run, inline script written to: %s", inline))
+	}
+	if p.config.pauseBefore > 0 {
+		ui.Say(fmt.Sprintf("Dry run, would pause %s before running scripts", p.config.pauseBefore))
+	}
+	if p.config.SetupScript != "" {
+		ui.Say(fmt.Sprintf("Dry run, would run setup script: %s", p.config.SetupScript))
+	}
+	for _, path := range p.config.BeforeScripts {
+		ui.Say(fmt.Sprintf("Dry run, would run before script: %s", path))
+	}
+
+	// Without a matrix the scripts run once, with the plain variables
+	matrix := p.config.Matrix
+	if len(matrix) == 0 {
+		matrix = []MatrixEntry{{}}
+	}
+
+	for _, entry := range matrix {
+		vars := envVars
+		if entry.Name != "" {
+			ui.Say(fmt.Sprintf("Dry run, matrix entry: %s", entry.Name))
+			vars = make([]string, 0, len(envVars)+len(entry.Vars)+1)
+			vars = append(vars, envVars...)
+			vars = append(vars, fmt.Sprintf("PACKER_SHELL_MATRIX_NAME=%s", entry.Name))
+			vars = append(vars, entry.Vars...)
+		}
+
+		for _, target := range targets {
+			for _, script := range scripts {
+				command, err := p.executeCommand(p.scriptPath(script.Path), vars, target)
+				if err != nil {
+					return fmt.Errorf("Error processing execute_command: %s", err)
+				}
+
+				ui.Say(fmt.Sprintf("Dry run, would execute: %s", command))
+				for _, kv := range vars {
+					ui.Message(kv)
+				}
+			}
+		}
+	}
+
+	for _, path := range p.config.AfterScripts {
+		ui.Say(fmt.Sprintf("Dry run, would run after script: %s", path))
+	}
+	if p.config.TeardownScript != "" {
+		ui.Say(fmt.Sprintf("Dry run, would run teardown script: %s", p.config.TeardownScript))
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readEnvFile reads a dotenv-style file of environment variables, one
+// "key=value" per line. Blank lines and lines starting with "#" are
+// skipped, an "export " prefix is allowed, and values may be wrapped in
+// single or double quotes, which are removed.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vars []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		vs := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(vs[0])
+		if len(vs) != 2 || key == "" {
+			return nil, fmt.Errorf("line %d not in format 'key=value'", n)
+		}
+
+		value := strings.TrimSpace(vs[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars = append(vars, key+"="+value)
+	}
+
+	return vars, scanner.Err()
+}
+
+// passedEnv returns the variables of Packer's environment whose names
+// match one of the patterns.
+func passedEnv(patterns []string) []string {
+	var vars []string
+	for _, kv := range os.Environ() {
+		vs := strings.SplitN(kv, "=", 2)
+		if vs[0] != "" && matchesAny(vs[0], patterns) {
+			vars = append(vars, kv)
+		}
+	}
+	return vars
+}
@@ -0,0 +1,93 @@
+package shell
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// executionLogOutputLength is how many characters of a script's stdout and
+// stderr are recorded in the execution log.
+const executionLogOutputLength = 4096
+
+// executionLogEntry is the JSON line recorded for every script run.
+type executionLogEntry struct {
+	Time     time.Time `json:"time"`
+	Build    string    `json:"build"`
+	Script   string    `json:"script"`
+	File     string    `json:"file"`
+	Matrix   string    `json:"matrix,omitempty"`
+	Argv     []string  `json:"argv"`
+	Duration float64   `json:"duration"`
+	ExitCode *int      `json:"exit_code"`
+	Error    string    `json:"error,omitempty"`
+	Stdout   string    `json:"stdout"`
+	Stderr   string    `json:"stderr"`
+}
+
+// commandArgv returns the command line the script is run with against
+// art, for the record. Remote and docker scripts are run by sh there.
+func (p *PostProcessor) commandArgv(script ScriptConfig, art string, envVars []string) []string {
+	command, err := p.executeCommand(p.scriptPath(script.Path), envVars, art)
+	if err != nil {
+		return nil
+	}
+
+	shell := p.config.Shell
+	if p.config.Remote != nil || p.config.DockerImage != "" {
+		shell = []string{"sh", "-c"}
+	}
+	return append(shell[:len(shell):len(shell)], command)
+}
+
+// appendExecutionLog appends a JSON line for every script that ran to the
+// log at path, creating it if needed, so a log can collect every build.
+// Scripts that were skipped aren't recorded, and secrets are masked with
+// redact.
+func appendExecutionLog(path string, build string, results []scriptResult, redact func(string) string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+
+		entry := executionLogEntry{
+			Time:     r.Start.UTC(),
+			Build:    build,
+			Script:   r.Script,
+			File:     r.File,
+			Matrix:   r.Matrix,
+			Duration: r.Duration.Seconds(),
+			Stdout:   truncateOutput(redact(r.Stdout), executionLogOutputLength),
+			Stderr:   truncateOutput(redact(r.Stderr), executionLogOutputLength),
+		}
+		for _, arg := range r.Argv {
+			entry.Argv = append(entry.Argv, redact(arg))
+		}
+
+		// Errors other than an exit code, such as a timeout, leave it
+		// null.
+		code := 0
+		if exitErr, ok := r.Err.(*ScriptError); ok {
+			code = exitErr.ExitCode
+		}
+		if r.Err == nil || code != 0 {
+			entry.ExitCode = &code
+		}
+		if r.Err != nil {
+			entry.Error = redact(r.Err.Error())
+		}
+
+		if err := enc.Encode(entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
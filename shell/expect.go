@@ -0,0 +1,71 @@
+package shell
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// outputSnippetLength is how many characters of a script's output are
+// quoted when it fails an output check.
+const outputSnippetLength = 200
+
+// checkOutput checks the stdout and stderr of a script that exited
+// successfully against the expect and fail patterns, returning an error
+// naming the first pattern that failed and the output it failed on.
+func (p *PostProcessor) checkOutput(stdout string, stderr string) error {
+	if p.config.FailOnStderr && stderr != "" {
+		return fmt.Errorf("wrote to stderr with fail_on_stderr set: %s", tailSnippet(stderr))
+	}
+
+	if err := failOutput("stdout", "fail_stdout_regex", p.config.failStdout, stdout); err != nil {
+		return err
+	}
+	if err := failOutput("stderr", "fail_stderr_regex", p.config.failStderr, stderr); err != nil {
+		return err
+	}
+
+	if err := expectOutput("stdout", "expect_stdout_regex", p.config.expectOutput, stdout); err != nil {
+		return err
+	}
+	return expectOutput("stderr", "expect_stderr_regex", p.config.expectStderr, stderr)
+}
+
+func failOutput(stream string, option string, re *regexp.Regexp, output string) error {
+	if re == nil {
+		return nil
+	}
+	loc := re.FindStringIndex(output)
+	if loc == nil {
+		return nil
+	}
+	return fmt.Errorf("%s matched %s '%s': %s", stream, option, re, matchSnippet(output, loc))
+}
+
+func expectOutput(stream string, option string, re *regexp.Regexp, output string) error {
+	if re == nil || re.MatchString(output) {
+		return nil
+	}
+	return fmt.Errorf("%s did not match %s '%s': %s", stream, option, re, tailSnippet(output))
+}
+
+// matchSnippet returns the lines of s holding the match at loc, shortened
+// to outputSnippetLength.
+func matchSnippet(s string, loc []int) string {
+	start := strings.LastIndex(s[:loc[0]], "\n") + 1
+	end := len(s)
+	if i := strings.Index(s[loc[1]:], "\n"); i >= 0 {
+		end = loc[1] + i
+	}
+	return truncateOutput(s[start:end], outputSnippetLength)
+}
+
+// tailSnippet returns the end of s, where tools usually report what went
+// wrong, shortened to outputSnippetLength.
+func tailSnippet(s string) string {
+	runes := []rune(s)
+	if len(runes) <= outputSnippetLength {
+		return s
+	}
+	return "..." + string(runes[len(runes)-outputSnippetLength:])
+}
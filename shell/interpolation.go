@@ -0,0 +1,159 @@
+package shell
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/mitchellh/packer/helper/config"
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+// templateActionRe matches the actions of a template, such as
+// "{{build_name}}" or "{{user `region`}}".
+var templateActionRe = regexp.MustCompile(`{{-?\s*(.*?)\s*-?}}`)
+
+// addExtraVars renders extra_vars and returns raws with them added to the
+// user variables Packer passes along, so that every template in the
+// configuration, whether rendered now or at run time, can use them like
+// user variables, as in "{{user `version`}}".
+func addExtraVars(raws []interface{}) ([]interface{}, error) {
+	extraVars := make(map[string]string)
+	for _, raw := range raws {
+		m, ok := rawMap(raw)
+		if !ok || m["extra_vars"] == nil {
+			continue
+		}
+
+		var vars map[string]string
+		if err := mapstructure.WeakDecode(m["extra_vars"], &vars); err != nil {
+			return nil, fmt.Errorf("Error decoding extra_vars: %s", err)
+		}
+		for k, v := range vars {
+			extraVars[k] = v
+		}
+	}
+	if len(extraVars) == 0 {
+		return raws, nil
+	}
+
+	ctx, err := config.DetectContext(raws...)
+	if err != nil {
+		return nil, err
+	}
+
+	userVars := make(map[string]string, len(ctx.UserVariables)+len(extraVars))
+	for k, v := range ctx.UserVariables {
+		userVars[k] = v
+	}
+	for k, v := range extraVars {
+		if _, ok := ctx.UserVariables[k]; ok {
+			return nil, fmt.Errorf("extra_vars %s is already a user variable", k)
+		}
+
+		rendered, err := interpolate.Render(v, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Error processing extra_vars %s: %s", k, err)
+		}
+		userVars[k] = rendered
+	}
+
+	return append(raws, map[string]interface{}{"packer_user_variables": userVars}), nil
+}
+
+// rawMap decodes a raw configuration into a map the way Packer's own
+// decoding does, as raws that come over RPC are map[interface{}]interface{}.
+func rawMap(raw interface{}) (map[string]interface{}, bool) {
+	var m map[string]interface{}
+	if err := mapstructure.Decode(raw, &m); err != nil || m == nil {
+		return nil, false
+	}
+	return m, true
+}
+
+// printInterpolation renders every templated string in the raw
+// configuration and logs what it references and what it resolves to, so
+// typos in template variables show up before a build runs. Fields in
+// exclude are rendered later, at run time, and only listed.
+func printInterpolation(raws []interface{}, ctx *interpolate.Context, exclude []string) {
+	for _, raw := range raws {
+		m, ok := rawMap(raw)
+		if !ok {
+			continue
+		}
+
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if strings.HasPrefix(k, "packer_") {
+				continue
+			}
+
+			skip := false
+			for _, e := range exclude {
+				if k == e {
+					skip = true
+				}
+			}
+
+			printInterpolationValue(k, m[k], ctx, skip)
+		}
+	}
+}
+
+func printInterpolationValue(name string, v interface{}, ctx *interpolate.Context, skip bool) {
+	switch v := v.(type) {
+	case string:
+		actions := templateActionRe.FindAllStringSubmatch(v, -1)
+		if len(actions) == 0 {
+			return
+		}
+
+		refs := make([]string, len(actions))
+		for i, a := range actions {
+			refs[i] = a[1]
+		}
+
+		if skip {
+			log.Printf("Interpolation of %s: references %s, rendered at run time",
+				name, strings.Join(refs, ", "))
+			return
+		}
+
+		rendered, err := interpolate.Render(v, ctx)
+		if err != nil {
+			log.Printf("Interpolation of %s: references %s, does not resolve: %s",
+				name, strings.Join(refs, ", "), err)
+			return
+		}
+
+		log.Printf("Interpolation of %s: references %s, resolves to %q",
+			name, strings.Join(refs, ", "), rendered)
+	case []interface{}:
+		for i, e := range v {
+			printInterpolationValue(fmt.Sprintf("%s[%d]", name, i), e, ctx, skip)
+		}
+	default:
+		m, ok := rawMap(v)
+		if !ok {
+			return
+		}
+
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			printInterpolationValue(name+"."+k, m[k], ctx, skip)
+		}
+	}
+}
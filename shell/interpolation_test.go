@@ -0,0 +1,125 @@
+package shell
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/packer/template/interpolate"
+)
+
+func TestAddExtraVars(t *testing.T) {
+	raws := []interface{}{
+		map[interface{}]interface{}{
+			"extra_vars": map[interface{}]interface{}{
+				"version": "1.{{user `minor`}}",
+			},
+		},
+		map[string]interface{}{
+			"packer_user_variables": map[string]string{"minor": "2"},
+		},
+	}
+
+	result, err := addExtraVars(raws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != len(raws)+1 {
+		t.Fatalf("bad: %#v", result)
+	}
+
+	m := result[len(result)-1].(map[string]interface{})
+	vars := m["packer_user_variables"].(map[string]string)
+	if vars["version"] != "1.2" || vars["minor"] != "2" {
+		t.Fatalf("bad: %#v", vars)
+	}
+}
+
+func TestAddExtraVars_none(t *testing.T) {
+	raws := []interface{}{
+		map[interface{}]interface{}{"inline": []interface{}{"true"}},
+	}
+
+	result, err := addExtraVars(raws)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(result) != len(raws) {
+		t.Fatalf("bad: %#v", result)
+	}
+}
+
+func TestAddExtraVars_userVariable(t *testing.T) {
+	raws := []interface{}{
+		map[interface{}]interface{}{
+			"extra_vars":            map[interface{}]interface{}{"minor": "3"},
+			"packer_user_variables": map[interface{}]interface{}{"minor": "2"},
+		},
+	}
+
+	if _, err := addExtraVars(raws); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestPrintInterpolation(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	raws := []interface{}{
+		map[interface{}]interface{}{
+			"output": "{{build_name}}.tar",
+			"remote": map[interface{}]interface{}{
+				"host": "{{user `host`}}",
+			},
+			"packer_user_variables": map[interface{}]interface{}{"host": "example.com"},
+		},
+	}
+	ctx := &interpolate.Context{
+		UserVariables: map[string]string{"host": "example.com"},
+	}
+	printInterpolation(raws, ctx, []string{"output"})
+
+	out := buf.String()
+	if !strings.Contains(out, "Interpolation of output: references build_name, rendered at run time") {
+		t.Fatalf("bad: %s", out)
+	}
+	if !strings.Contains(out, `Interpolation of remote.host: references user `+"`host`"+`, resolves to "example.com"`) {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestPostProcessorConfigure_printInterpolation(t *testing.T) {
+	cases := map[interface{}]bool{
+		true:    true,
+		"true":  true,
+		"1":     true,
+		1:       true,
+		false:   false,
+		"false": false,
+	}
+
+	for value, expected := range cases {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+
+		config := testConfig(t)
+		config["print_interpolation"] = value
+		config["inline"] = []interface{}{"echo {{user `missing`}}"}
+
+		var p PostProcessor
+		err := p.Configure(config)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("%#v: err: %s", value, err)
+		}
+
+		printed := strings.Contains(buf.String(), "Interpolation of inline[0]")
+		if printed != expected {
+			t.Fatalf("%#v: bad: %s", value, buf.String())
+		}
+	}
+}
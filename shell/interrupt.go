@@ -0,0 +1,41 @@
+package shell
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// interrupted is closed once the plugin is interrupted, such as when
+// Packer is stopped with Ctrl-C, so running scripts are stopped and no
+// more are started. Scripts run in their own process group, so they don't
+// see the interrupt themselves.
+var interrupted = make(chan struct{})
+
+var watchInterruptsOnce sync.Once
+
+// watchInterrupts starts watching for the signals that interrupt the
+// plugin. It only has an effect the first time it is called.
+func watchInterrupts() {
+	watchInterruptsOnce.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-ch
+			log.Printf("Received %s, stopping scripts", sig)
+			close(interrupted)
+		}()
+	})
+}
+
+// isInterrupted reports whether the plugin has been interrupted.
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package shell
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+type junitFailure struct {
+	Message  string `xml:"message,attr"`
+	Contents string `xml:",chardata"`
+}
+
+// writeJUnitReport writes the results as a JUnit XML report, one test
+// case per script and artifact file combination, or per file for the
+// files of an excluded artifact.
+func writeJUnitReport(path string, name string, results []scriptResult) error {
+	if name == "" {
+		name = "shell"
+	}
+	suite := junitTestSuite{Name: name}
+
+	var total float64
+	for _, r := range results {
+		className := "shell"
+		if r.Matrix != "" {
+			className = fmt.Sprintf("shell.%s", r.Matrix)
+		}
+
+		name := r.File
+		if r.Script != "" {
+			name = fmt.Sprintf("%s %s", r.Script, r.File)
+		}
+		tc := junitTestCase{
+			ClassName: className,
+			Name:      name,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+			SystemOut: r.Stdout,
+			SystemErr: r.Stderr,
+		}
+
+		switch {
+		case r.Skipped:
+			tc.Skipped = &junitSkipped{Message: r.SkipReason}
+			suite.Skipped++
+		case r.Err != nil:
+			tc.Failure = &junitFailure{
+				Message:  r.Err.Error(),
+				Contents: r.Stderr,
+			}
+			suite.Failures++
+		}
+
+		total += r.Duration.Seconds()
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Tests = len(suite.Cases)
+	suite.Time = fmt.Sprintf("%.3f", total)
+
+	out, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(out, '\n')...), 0644)
+}
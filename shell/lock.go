@@ -0,0 +1,53 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// lockPollInterval is how often a lock held by another process is tried
+// again.
+const lockPollInterval = 250 * time.Millisecond
+
+// lockPath returns the file locked for lock_name or lock_file, shared by
+// every process using the same name, such as the post-processors of the
+// builds of a template running in parallel.
+func (p *PostProcessor) lockPath() string {
+	if p.config.LockFile != "" {
+		return p.config.LockFile
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("packer-shell-%s.lock", p.config.LockName))
+}
+
+// acquireLock takes the exclusive lock on path, waiting for up to timeout
+// for another process to release it, or for ever when timeout is zero.
+// Closing the returned file releases the lock, as does the process
+// exiting, however it exits.
+func acquireLock(ui packer.Ui, path string, timeout time.Duration) (*os.File, error) {
+	start := time.Now()
+	for waiting := false; ; waiting = true {
+		f, err := tryLock(path)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			return f, nil
+		}
+
+		if !waiting {
+			ui.Message(fmt.Sprintf("Waiting for lock held by another build: %s", path))
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			return nil, fmt.Errorf("timed out after %s", timeout)
+		}
+		if isInterrupted() {
+			return nil, errors.New("interrupted")
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
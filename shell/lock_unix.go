@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on the file at path, creating it if
+// needed. It returns nil without an error when another process holds
+// the lock.
+func tryLock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
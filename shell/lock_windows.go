@@ -0,0 +1,30 @@
+package shell
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is returned when opening a file another process
+// has open without sharing it.
+const errorSharingViolation syscall.Errno = 32
+
+// tryLock opens the file at path, creating it if needed, without sharing
+// it, which locks out every other process until it is closed. It returns
+// nil without an error when another process holds the lock.
+func tryLock(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
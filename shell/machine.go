@@ -0,0 +1,67 @@
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// machineEnvRe matches the characters not allowed in the environment
+// variable names machine-readable fields are forwarded as.
+var machineEnvRe = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// readMachineFields reads a log of Packer's machine-readable output and
+// returns the data of the last message of each of the given types that
+// was addressed to the build, or to no build in particular.
+//
+// Each line has the form "timestamp,target,type,data...". Commas within
+// the data are escaped as "%!(PACKER_COMMA)" and newlines as "\n"; both
+// are unescaped, and the data parts are joined back with commas.
+func readMachineFields(path string, build string, types []string) (map[string]string, error) {
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		parts := strings.Split(scanner.Text(), ",")
+		if len(parts) < 3 || !wanted[parts[2]] {
+			continue
+		}
+		if parts[1] != "" && parts[1] != build {
+			continue
+		}
+
+		data := parts[3:]
+		for i, d := range data {
+			d = strings.Replace(d, "%!(PACKER_COMMA)", ",", -1)
+			data[i] = strings.Replace(d, `\n`, "\n", -1)
+		}
+		fields[parts[2]] = strings.Join(data, ",")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// machineFieldEnv returns the environment variable a machine-readable
+// message type is forwarded as, such as PACKER_MACHINE_ARTIFACT_COUNT for
+// "artifact-count".
+func machineFieldEnv(t string, value string) string {
+	name := machineEnvRe.ReplaceAllString(strings.ToUpper(t), "_")
+	return fmt.Sprintf("PACKER_MACHINE_%s=%s", name, value)
+}
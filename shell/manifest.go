@@ -0,0 +1,61 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// artifactManifest is the JSON description of the input artifact written
+// for write_artifact_manifest.
+type artifactManifest struct {
+	Id        string                 `json:"id"`
+	BuilderId string                 `json:"builder_id"`
+	Files     []string               `json:"files"`
+	String    string                 `json:"string"`
+	State     map[string]interface{} `json:"state"`
+}
+
+// writeArtifactManifest writes the artifact, with the state values under
+// the given names, as JSON to a new temporary file in dir. State values
+// that can't be represented as JSON are written as their string form.
+func writeArtifactManifest(dir string, artifact packer.Artifact, state []string) (string, error) {
+	manifest := artifactManifest{
+		Id:        artifact.Id(),
+		BuilderId: artifact.BuilderId(),
+		Files:     artifact.Files(),
+		String:    artifact.String(),
+		State:     make(map[string]interface{}),
+	}
+	if manifest.Files == nil {
+		manifest.Files = []string{}
+	}
+
+	for _, name := range state {
+		v := artifact.State(name)
+		if _, err := json.Marshal(v); err != nil {
+			v = fmt.Sprintf("%v", v)
+		}
+		manifest.State[name] = v
+	}
+
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(dir, "packer-shell-manifest*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(out); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
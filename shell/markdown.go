@@ -0,0 +1,98 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// markdownOutputLength is how many characters of a script's output are
+// shown in the Markdown report.
+const markdownOutputLength = 200
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"`", "\\`",
+	"*", `\*`,
+	"_", `\_`,
+	"[", `\[`,
+	"]", `\]`,
+	"|", `\|`,
+	"<", "&lt;",
+	">", "&gt;",
+	"\r\n", "<br>",
+	"\n", "<br>",
+)
+
+// writeMarkdownReport writes the results as a Markdown summary with the
+// overall outcome at the top and a table row per script and artifact
+// file combination.
+func writeMarkdownReport(path string, name string, results []scriptResult) error {
+	if name == "" {
+		name = "shell"
+	}
+
+	var failed, skipped int
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			skipped++
+		case r.Err != nil:
+			failed++
+		}
+	}
+
+	outcome := "passed"
+	if failed > 0 {
+		outcome = "failed"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Shell post-processor report: %s\n\n", markdownEscaper.Replace(name))
+	fmt.Fprintf(&buf, "**Result: %s** (%d runs, %d failed, %d skipped)\n\n",
+		outcome, len(results)-skipped, failed, skipped)
+
+	buf.WriteString("| Script | File | Matrix | Status | Exit code | Duration | Output |\n")
+	buf.WriteString("| --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, r := range results {
+		status, code := "passed", "0"
+		switch {
+		case r.Skipped:
+			status, code = "skipped", "-"
+		case r.Err != nil:
+			status, code = "failed", "-"
+			if exitErr, ok := r.Err.(*ScriptError); ok {
+				code = fmt.Sprintf("%d", exitErr.ExitCode)
+			}
+		}
+
+		// The exit code and stderr already tell why a script that exited
+		// with an invalid code failed, while other errors explain more.
+		output := strings.TrimSpace(r.Stdout + "\n" + r.Stderr)
+		if _, ok := r.Err.(*ScriptError); r.Err != nil && !ok {
+			output = strings.TrimSpace(r.Err.Error() + "\n" + output)
+		}
+
+		fmt.Fprintf(&buf, "| %s | %s | %s | %s | %s | %s | %s |\n",
+			markdownEscaper.Replace(r.Script),
+			markdownEscaper.Replace(r.File),
+			markdownEscaper.Replace(r.Matrix),
+			status,
+			code,
+			r.Duration,
+			markdownEscaper.Replace(truncateOutput(output, markdownOutputLength)))
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// truncateOutput shortens s to at most n characters, marking where it was
+// cut.
+func truncateOutput(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n]) + "..."
+}
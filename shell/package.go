@@ -0,0 +1,88 @@
+package shell
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// packageFiles archives the files, and the contents of any directories
+// among them, into a gzipped tarball at path. Entries are named relative
+// to the directory holding each file.
+func packageFiles(path string, files []string, level int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		base := filepath.Dir(file)
+		err := filepath.Walk(file, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return addTarEntry(tw, base, path, fi)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func addTarEntry(tw *tar.Writer, base string, path string, fi os.FileInfo) error {
+	name, err := filepath.Rel(base, path)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,57 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// pidFile is an informational file holding the PID of the running
+// post-processor and what it is currently doing, so that operators can
+// see what's running and kill a stuck run.
+type pidFile struct {
+	sync.Mutex
+	path string
+}
+
+// createPidFile writes a new PID file, refusing to replace one that
+// belongs to a process that is still running. A file left behind by a
+// process that no longer exists is stale and replaced.
+func createPidFile(path string) (*pidFile, error) {
+	if contents, err := ioutil.ReadFile(path); err == nil {
+		line := strings.SplitN(string(contents), "\n", 2)[0]
+		if pid, err := strconv.Atoi(strings.TrimSpace(line)); err == nil && pid != os.Getpid() {
+			if processAlive(pid) {
+				return nil, fmt.Errorf("PID file %s belongs to running process %d", path, pid)
+			}
+			log.Printf("Replacing stale PID file %s of process %d", path, pid)
+		}
+	}
+
+	f := &pidFile{path: path}
+	if err := f.Update("starting"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Update records what the post-processor is currently doing.
+func (f *pidFile) Update(status string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	contents := fmt.Sprintf("%d\n%s\n", os.Getpid(), status)
+	return ioutil.WriteFile(f.path, []byte(contents), 0644)
+}
+
+// Remove deletes the PID file once the run is over.
+func (f *pidFile) Remove() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return os.Remove(f.path)
+}
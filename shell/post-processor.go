@@ -5,14 +5,30 @@ package shell
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
@@ -23,8 +39,37 @@ type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 
 	// Fields from config file
-	OutputPath        string `mapstructure:"output"`
-	KeepInputArtifact bool   `mapstructure:"keep_input_artifact"`
+	KeepInputArtifact bool `mapstructure:"keep_input_artifact"`
+
+	// Where the scripts write what they produce, returned as the new
+	// artifact. A template with .BuildName and .BuilderType, and a glob
+	// when several files are produced.
+	OutputPath string `mapstructure:"output"`
+
+	// Whether the output "replace"s the input artifact (the default) or
+	// "supplement"s it, adding the produced files to the input's.
+	OutputArtifact string `mapstructure:"output_artifact"`
+
+	// Package the artifact files into an archive at OutputPath once the
+	// scripts succeed, returning it as the new artifact. Only "tar.gz" is
+	// supported.
+	Package string `mapstructure:"package"`
+
+	// The gzip compression level used for packaging, from 1 (fastest) to
+	// 9 (smallest). Zero uses the gzip default.
+	CompressionLevel int `mapstructure:"compression_level"`
+
+	// Deprecated and rejected when set: the input artifact is always kept
+	// when a script fails.
+	KeepOnFailure bool `mapstructure:"keep_on_failure"`
+
+	// The scripts are only run for their side effects: the input artifact
+	// is always returned as is and kept.
+	SideEffectOnly bool `mapstructure:"side_effect_only"`
+
+	// Once the scripts succeed, return no artifact and have Packer destroy
+	// the input, for scripts that move the artifact elsewhere.
+	DiscardArtifact bool `mapstructure:"discard_artifact"`
 
 	// An inline script to execute. Multiple strings are all executed
 	// in the context of a single shell.
@@ -33,31 +78,693 @@ type Config struct {
 	// The shebang value used when running inline scripts.
 	InlineShebang string `mapstructure:"inline_shebang"`
 
+	// The interpreter and its arguments the default execute_command runs
+	// the scripts with, such as ["python3", "-u"], instead of executing
+	// them directly. The inline script then gets no shebang.
+	Interpreter []string `mapstructure:"interpreter"`
+
 	// The local path of the shell script to upload and execute.
 	Script string
 
-	// An array of multiple scripts to run.
-	Scripts []string
+	// An array of multiple scripts to run. Each entry is either a path or
+	// an object with a "path" and settings for just that script.
+	Scripts []interface{}
+
+	// Another way of giving scripts, for when most entries are objects
+	// with settings of their own.
+	Steps []interface{} `mapstructure:"steps"`
+
+	// The checksums scripts given as URLs must have, by URL, as
+	// "type:checksum" or a bare sha256 checksum.
+	ScriptChecksums map[string]string `mapstructure:"script_checksums"`
+
+	// A directory scripts given as URLs are downloaded to and reused from
+	// by later runs, instead of being downloaded to a temporary file
+	// every time.
+	ScriptCacheDir string `mapstructure:"script_cache_dir"`
+
+	// A directory of scripts to run in the order of their names, like
+	// run-parts. Only executable files are run, unless ScriptsDirPattern
+	// is given, in which case the files matching it are.
+	ScriptsDir        string `mapstructure:"scripts_dir"`
+	ScriptsDirPattern string `mapstructure:"scripts_dir_pattern"`
+
+	// The directory the scripts run in. Unset runs them in Packer's
+	// current directory.
+	WorkingDirectory string `mapstructure:"working_directory"`
+
+	// Extra arguments passed to every script after the artifact file.
+	ScriptArgs []string `mapstructure:"script_args"`
+
+	// A Printf format given the name and value of each environment
+	// variable, making up .Vars in execute_command. Unset quotes the values
+	// for the shell.
+	EnvVarFormat string `mapstructure:"env_var_format"`
+
+	// The shell and its arguments that commands are run with, the
+	// command being passed last. Defaults to cmd /C on Windows and
+	// sh -c elsewhere; powershell and pwsh are also understood.
+	Shell []string `mapstructure:"shell"`
+
+	// Shorthand for running commands with PowerShell, allowed to run the
+	// scripts whatever the execution policy.
+	UsePowerShell bool `mapstructure:"use_powershell"`
+
+	// The command used to run each script against an artifact file, a
+	// template with .Path, .Vars, .Artifact and .Args that is run with
+	// the shell.
+	ExecuteCommand string `mapstructure:"execute_command"`
+
+	// The exit codes a script may exit with and still succeed. Defaults
+	// to just 0.
+	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
+
+	// The number of times a failing script is retried before giving up.
+	MaxRetries int `mapstructure:"max_retries"`
+
+	// How long to wait before retrying a failed script, as a duration
+	// string. Unset retries right away.
+	RawRetryDelay string `mapstructure:"retry_delay"`
+
+	// What the delay is multiplied by after every retry, such as 2 for
+	// exponential backoff. Defaults to 1, a constant delay.
+	RetryBackoff float64 `mapstructure:"retry_backoff"`
+
+	// The longest the delay grows to with retry_backoff, as a duration
+	// string. Unset means no limit.
+	RawRetryMaxDelay string `mapstructure:"retry_max_delay"`
+
+	// The exit codes a failing script is retried for. Unset retries it
+	// whatever made it fail.
+	RetryableExitCodes []int `mapstructure:"retryable_exit_codes"`
+
+	// How long to wait before running the first script, and between one
+	// script and the next for the same artifact file, as duration
+	// strings. Meant for things that are only eventually consistent, such
+	// as a new AMI becoming available. Unset doesn't wait.
+	RawPauseBefore  string `mapstructure:"pause_before"`
+	RawPauseBetween string `mapstructure:"pause_between"`
+
+	// How long a script may run before it is killed, as a duration
+	// string. Zero or unset means no timeout.
+	RawTimeout string `mapstructure:"timeout"`
+
+	// How long all the scripts together may run for an artifact, as a
+	// duration string. Whatever is running when it passes is killed, and
+	// nothing more is started. Zero or unset means no limit.
+	RawTotalTimeout string `mapstructure:"total_timeout"`
+
+	// How long a script that is stopped, on timeout or when Packer is
+	// interrupted, gets to exit after SIGTERM before it is killed, as a
+	// duration string. Defaults to 10s.
+	RawKillTimeout string `mapstructure:"kill_timeout"`
+
+	// Timeouts for artifact files by extension, such as ".iso", taking
+	// precedence over timeout.
+	RawTimeoutByExtension map[string]string `mapstructure:"timeout_by_extension"`
 
 	// An array of environment variables that will be injected before
 	// your command(s) are executed.
 	Vars []string `mapstructure:"environment_vars"`
 
-	ctx interpolate.Context
+	// Variables added to Packer's user variables for the templates of
+	// this configuration, rendered themselves with the user variables.
+	ExtraVars map[string]string `mapstructure:"extra_vars"`
+
+	// A dotenv-style file of further environment variables, and globs
+	// such as "AWS_*" naming variables of Packer's environment to pass on
+	// explicitly. environment_vars take precedence over the file, which
+	// takes precedence over the passed environment.
+	EnvVarsFile string   `mapstructure:"environment_vars_file"`
+	PassEnv     []string `mapstructure:"pass_env"`
+
+	// Only process artifacts whose builder id starts with one of these
+	// prefixes, or skip those that do.
+	OnlyBuilderIds   []string `mapstructure:"only_builder_ids"`
+	ExceptBuilderIds []string `mapstructure:"except_builder_ids"`
+
+	// Only process artifacts of builds whose builder type or build name
+	// matches one of these globs, or skip those that do.
+	OnlyBuilderTypes   []string `mapstructure:"only_builder_types"`
+	ExceptBuilderTypes []string `mapstructure:"except_builder_types"`
+	OnlyBuildNames     []string `mapstructure:"only_build_names"`
+	ExceptBuildNames   []string `mapstructure:"except_build_names"`
+
+	// Process each artifact id only once, skipping any artifact whose id
+	// was already seen by this post-processor.
+	DedupById bool `mapstructure:"dedup_by_id"`
+
+	// The Go time layout of PACKER_BUILD_TIMESTAMP, such as
+	// "20060102150405". Defaults to RFC 3339.
+	TimestampFormat string `mapstructure:"timestamp_format"`
+
+	// The directory temporary files are created in, both by the
+	// post-processor and, through TMPDIR, by the scripts. Unset uses the
+	// system's temporary directory.
+	TmpDir string `mapstructure:"tmp_dir"`
+
+	// The directory the inline script and downloaded scripts are written
+	// to, for when tmp_dir is mounted noexec. Defaults to tmp_dir.
+	TempDir string `mapstructure:"temp_dir"`
+
+	// The locale the scripts run with, such as "C.UTF-8", set as both
+	// LC_ALL and LANG. Unset inherits Packer's locale.
+	Locale string `mapstructure:"locale"`
+
+	// A file holding Packer's machine-readable output, such as one written
+	// with "packer build -machine-readable | tee build.log", and the
+	// message types to forward from it to the scripts' environment.
+	MachineReadableFile  string   `mapstructure:"machine_readable_file"`
+	ForwardMachineFields []string `mapstructure:"forward_machine_fields"`
+
+	// Environment variables whose values are the output of a command, in
+	// the form "key=command". The commands are run when the
+	// post-processor starts, and again before every retry when
+	// RefreshOnRetry is set.
+	DynamicVars    []string `mapstructure:"dynamic_environment_vars"`
+	RefreshOnRetry bool     `mapstructure:"refresh_on_retry"`
+
+	// The disk space, such as "10G", that must be free on the filesystem
+	// the output is written to for the scripts to run.
+	MinFreeSpace string `mapstructure:"min_free_space"`
+
+	// A command run before any script. When it exits non-zero the
+	// scripts are skipped and the input artifact is returned unchanged.
+	Precondition string `mapstructure:"precondition"`
+
+	// Environment variables set only for the precondition command, on
+	// top of the ones the scripts get.
+	PreconditionVars []string `mapstructure:"precondition_environment_vars"`
+
+	// A script run once before any artifact file is processed, and one run
+	// once after all of them, even if something failed.
+	SetupScript    string `mapstructure:"setup_script"`
+	TeardownScript string `mapstructure:"teardown_script"`
+
+	// A script run when any of the scripts fails, to undo what the ones
+	// before it did. Its own failure is reported but doesn't replace the
+	// original error.
+	CompensationScript string `mapstructure:"compensation_script"`
+
+	// Scripts run in order before the scripts, after they all succeeded,
+	// and when any script failed, including these. Error scripts are
+	// told what failed, and their own failures are only reported.
+	BeforeScripts []string `mapstructure:"before_scripts"`
+	AfterScripts  []string `mapstructure:"after_scripts"`
+	ErrorScripts  []string `mapstructure:"error_scripts"`
+
+	// What happens when a script fails: "abort" fails the build,
+	// "cleanup_script" runs compensation_script first, and "continue"
+	// only reports the failure, returning the input artifact. Defaults to
+	// "cleanup_script" with a compensation_script and "abort" otherwise.
+	OnFailure string `mapstructure:"on_failure"`
+
+	// Where the files the scripts run against come from: "files" (the
+	// default) for the artifact's files, or "state:<key>" for the paths
+	// in the artifact's state under that key.
+	ArtifactSource string `mapstructure:"artifact_source"`
+
+	// The maximum combined size in bytes of the artifact files passed to
+	// a single script invocation. Files are batched greedily in order,
+	// and each batch is passed as separate arguments. Unset runs the
+	// scripts once per file.
+	BatchMaxBytes int64 `mapstructure:"batch_max_bytes"`
+
+	// Whether each script runs "per_file" (the default), or "once" with
+	// all the artifact files as separate arguments, and newline separated
+	// in PACKER_ARTIFACT_FILES.
+	ExecuteMode string `mapstructure:"execute_mode"`
+
+	// Another way of setting execute_mode: "file" runs the scripts per
+	// file, "artifact" once per artifact, and "once" only for the first
+	// artifact the post-processor is given.
+	ExecutionScope string `mapstructure:"execution_scope"`
+
+	// Process the artifact files concurrently, each running its scripts
+	// in order. OutputOrder is "interleaved" (the default) to show output
+	// as it happens, or "grouped" to show the output of each file in one
+	// piece, in the order of the files.
+	Parallel    bool   `mapstructure:"parallel"`
+	OutputOrder string `mapstructure:"output_order"`
+
+	// How many files are processed at once with Parallel. Defaults to
+	// the number of CPUs.
+	ParallelJobs int `mapstructure:"parallel_jobs"`
+
+	// Another way of setting parallel_jobs, turning on Parallel when
+	// greater than one.
+	MaxParallel int `mapstructure:"max_parallel"`
+
+	// With Parallel, stop starting files once one failed instead of
+	// processing them all and reporting every failure.
+	FailFast bool `mapstructure:"fail_fast"`
+
+	// The most scripts that may run at the same time, however they came
+	// to run concurrently. Unset means no limit.
+	GlobalMaxParallel int `mapstructure:"global_max_parallel"`
+
+	// Run the scripts for an artifact holding an exclusive lock shared
+	// with other processes, named by lock_name or the file to lock, so
+	// parallel builds take turns. lock_timeout bounds the wait for it as
+	// a duration string; unset waits for as long as it takes.
+	LockName       string `mapstructure:"lock_name"`
+	LockFile       string `mapstructure:"lock_file"`
+	RawLockTimeout string `mapstructure:"lock_timeout"`
+
+	// Process the artifact files in the reverse of the order the
+	// artifact lists them.
+	Reverse bool `mapstructure:"reverse"`
+
+	// Secrets delivered to the scripts through named pipes. Each key is
+	// the name of the environment variable holding the pipe's path and
+	// each value the secret written to it. Not supported on Windows.
+	SecretPipes map[string]string `mapstructure:"secret_pipes"`
+
+	// Environment variables whose values are secrets fetched when the
+	// scripts run, keyed by variable name. Each value says where the
+	// secret comes from: "env://NAME", "file://PATH" or
+	// "vault://PATH#KEY". The secrets are masked in the UI and the logs.
+	SecretVars map[string]string `mapstructure:"secret_vars"`
+
+	// Globs naming environment variables whose values are masked in the
+	// UI and the logs like secrets, and regular expressions whose matches
+	// are.
+	SensitiveVars     []string `mapstructure:"sensitive_vars"`
+	SensitivePatterns []string `mapstructure:"sensitive_patterns"`
+
+	// Named sets of environment variables. When given, the scripts are
+	// run once per entry with that entry's variables added.
+	Matrix []MatrixEntry `mapstructure:"matrix"`
+
+	// A regular expression that the stdout of every script must match
+	// for the script to be considered successful.
+	ExpectOutput string `mapstructure:"expect_output"`
+
+	// Regular expressions the stdout and stderr of every script must
+	// match. expect_stdout_regex is another name for expect_output.
+	ExpectStdoutRegex string `mapstructure:"expect_stdout_regex"`
+	ExpectStderrRegex string `mapstructure:"expect_stderr_regex"`
+
+	// Regular expressions that fail a script when its stdout or stderr
+	// matches, even if it exited successfully.
+	FailStdoutRegex string `mapstructure:"fail_stdout_regex"`
+	FailStderrRegex string `mapstructure:"fail_stderr_regex"`
+
+	// Fail a script that writes anything to stderr.
+	FailOnStderr bool `mapstructure:"fail_on_stderr"`
+
+	// Mount a tmpfs scratch directory for the scripts, exposed to them
+	// as PACKER_SCRATCH_DIR. Falls back to a regular temporary directory
+	// when tmpfs can't be mounted.
+	ScratchDir bool `mapstructure:"scratch_dir"`
+
+	// The size of the tmpfs scratch directory, such as "512m" or "10%".
+	ScratchSize string `mapstructure:"scratch_size"`
+
+	// Run the scripts in a new network namespace without any network
+	// access. Linux only, and requires root.
+	NetworkIsolation bool `mapstructure:"network_isolation"`
+
+	// Run the scripts under strace (Linux) or dtruss (macOS) to capture
+	// the system calls they make, writing a trace per script run to the
+	// TraceOutput directory.
+	TraceSyscalls bool   `mapstructure:"trace_syscalls"`
+	TraceOutput   string `mapstructure:"trace_output"`
+
+	// Compute a checksum of each artifact file and pass it to the scripts
+	// as PACKER_ARTIFACT_<TYPE>, such as PACKER_ARTIFACT_SHA256.
+	ComputeChecksum bool `mapstructure:"compute_checksum"`
+
+	// The checksum algorithm: "md5", "sha1", "sha256" (the default) or
+	// "sha512".
+	ChecksumType string `mapstructure:"checksum_type"`
+
+	// Several checksum algorithms to compute at once, instead of the
+	// single checksum_type.
+	ChecksumTypes []string `mapstructure:"checksum_types"`
+
+	// Write each computed checksum next to the artifact file, such as
+	// "disk.img.sha256", in the format of sha256sum and friends.
+	ChecksumFile bool `mapstructure:"checksum_file"`
+
+	// Expose the computed checksums in the state of the returned
+	// artifact, under "checksums".
+	ChecksumState bool `mapstructure:"checksum_state"`
+
+	// Fail if a script modifies any of the artifact files, detected by
+	// comparing their checksums before and after it runs.
+	ReadOnly bool `mapstructure:"read_only"`
+
+	// How a changed artifact file is detected: "hash" (the default)
+	// compares the contents, "mtime" the modification time and "size"
+	// the size.
+	ChangeDetection string `mapstructure:"change_detection"`
+
+	// Skip the scripts when a successful run already processed the same
+	// artifact files with the same scripts and environment variables, as
+	// recorded in cache_dir.
+	SkipIfUnchanged bool   `mapstructure:"skip_if_unchanged"`
+	CacheDir        string `mapstructure:"cache_dir"`
+
+	// Supplementary groups, by name or GID, the scripts run with. Not
+	// supported on Windows.
+	Groups []string `mapstructure:"groups"`
+
+	// The privilege-escalation command the scripts are run through, such
+	// as ["sudo", "-n"] or ["doas"], with use_sudo a shorthand for the
+	// former. The environment variables are handed over with env, since
+	// sudo and doas reset the environment. ExecuteAs is the user to run
+	// the scripts as, passed with -u, otherwise root.
+	ElevateCommand []string `mapstructure:"elevate_command"`
+	UseSudo        bool     `mapstructure:"use_sudo"`
+	ExecuteAs      string   `mapstructure:"execute_as"`
+
+	// Files opened and inherited by the scripts as file descriptors 3 and
+	// up, in order. Not supported on Windows.
+	ExtraFiles []string `mapstructure:"extra_files"`
+
+	// What the scripts get as stdin: "close" (the default) gives them an
+	// empty pipe that's closed right away, "null" the null device and
+	// "inherit" Packer's own stdin.
+	StdinBehavior string `mapstructure:"stdin_behavior"`
+
+	// What the scripts read as stdin instead: the given string, or the
+	// contents of the given file.
+	Stdin     string `mapstructure:"stdin"`
+	StdinFile string `mapstructure:"stdin_file"`
+
+	// Connect the scripts to a pseudo-terminal instead of pipes, for
+	// tools that refuse to run non-interactively. Only supported on
+	// Linux.
+	Pty bool `mapstructure:"pty"`
+
+	// The name the spawned shell is invoked as, which is both its argv[0]
+	// and $0. Defaults to "sh".
+	ShellArgv0 string `mapstructure:"shell_argv0"`
+
+	// A template for the title the script processes show up with in ps
+	// and top, such as "packer-shell: {{.Script}} (build={{.BuildName}})".
+	// Ignored on Windows.
+	ProcessTitleTemplate string `mapstructure:"process_title_template"`
+
+	// List the files in the directory scripts run in after each script,
+	// to see what it produced.
+	ListOutputDir bool `mapstructure:"list_output_dir"`
+
+	// Report the CPU time and peak memory used by each script after it
+	// finishes.
+	ReportResourceUsage bool `mapstructure:"report_resource_usage"`
+
+	// Report the progress scripts print as "PACKER_SHELL_SET progress=NN"
+	// lines on stdout while they run.
+	Progress bool `mapstructure:"progress"`
+
+	// Path of a file the output of every script is written to. It is a
+	// template rendered for every script run, with .ArtifactBase,
+	// .ArtifactDir and .Script, so each file or script can get a file of
+	// its own.
+	CaptureOutput string `mapstructure:"capture_output"`
+
+	// Fail instead of overwriting capture_output when it already exists.
+	CaptureOutputNoClobber bool `mapstructure:"capture_output_no_clobber"`
+
+	// The most bytes of stdout, and of stderr, kept in memory for each
+	// script run, and which end of the output is kept when there's more:
+	// "tail" (the default) or "head". Zero or unset means no limit.
+	MaxOutputBytes   int    `mapstructure:"max_output_bytes"`
+	OutputTruncation string `mapstructure:"output_truncation"`
+
+	// Path of a file the whole output of every script run is appended to
+	// as it arrives, whatever max_output_bytes keeps. A template like
+	// capture_output.
+	OutputFile string `mapstructure:"output_file"`
+
+	// Path of a file holding the PID of the post-processor and the script
+	// it's currently running, removed once the run is over.
+	PidFile string `mapstructure:"pid_file"`
+
+	// Path of a JUnit XML report to write with a test case for every
+	// script and artifact file combination.
+	JUnitReport string `mapstructure:"junit_report"`
+
+	// Path of a Markdown summary of the run to write at the end, with the
+	// overall outcome and a table of every script run.
+	MarkdownReport string `mapstructure:"markdown_report"`
+
+	// Path of a log to append a JSON line to for every script run, with
+	// its command line, duration, exit code and the end of its output.
+	ExecutionLog string `mapstructure:"execution_log"`
+
+	// Expose the effective configuration to the scripts as JSON in
+	// PACKER_SHELL_CONFIG_JSON, with secrets masked.
+	ExposeConfig bool `mapstructure:"expose_config"`
+
+	// Run the scripts on another machine over SSH instead of locally.
+	Remote *RemoteConfig `mapstructure:"remote"`
+
+	// Run the scripts in a new container of this image instead of on the
+	// host, with the extra volumes and docker run arguments given.
+	DockerImage   string   `mapstructure:"docker_image"`
+	DockerVolumes []string `mapstructure:"docker_volumes"`
+	DockerRunArgs []string `mapstructure:"docker_run_args"`
+
+	// Write the input artifact as JSON to a temporary file whose path is
+	// passed in PACKER_ARTIFACT_MANIFEST, including the artifact state
+	// under the names in artifact_manifest_state.
+	WriteArtifactManifest bool     `mapstructure:"write_artifact_manifest"`
+	ArtifactManifestState []string `mapstructure:"artifact_manifest_state"`
+
+	// Also write the environment variables to a file scripts can source,
+	// whose path is in PACKER_SHELL_ENV_FILE.
+	EnvFile bool `mapstructure:"env_file"`
+
+	// Log every templated option, what it references and what it
+	// resolves to while the configuration is read.
+	PrintInterpolation bool `mapstructure:"print_interpolation"`
+
+	// What to do when there turn out to be no scripts to run, such as when
+	// scripts_dir is empty: "error", "warn" (the default) or "skip".
+	OnNoScripts string `mapstructure:"on_no_scripts"`
+
+	// How much is shown in the UI: "quiet" shows only errors, "normal"
+	// (the default) the progress and output of each script, and "verbose"
+	// also the commands they're run with.
+	OutputLevel string `mapstructure:"output_level"`
+
+	// When the output of the scripts is shown: "stream" (the default)
+	// shows it line by line as it arrives, "buffered" all at once when
+	// the script is done.
+	OutputMode string `mapstructure:"output_mode"`
+
+	// Report the command and environment each script would be run with
+	// instead of running anything, returning the artifact unchanged.
+	DryRun bool `mapstructure:"dry_run"`
+
+	// Ask before running any script, skipping them unless the answer is
+	// yes. PACKER_SHELL_AUTO_APPROVE answers for CI.
+	Confirm bool `mapstructure:"confirm"`
+
+	// Controls when temporary files created by the post-processor are
+	// left on disk instead of being removed: "never" (the default),
+	// "always" or "on_failure".
+	SkipClean string `mapstructure:"skip_clean"`
+
+	ctx          interpolate.Context
+	expectOutput *regexp.Regexp
+	expectStderr *regexp.Regexp
+	failStdout   *regexp.Regexp
+	failStderr   *regexp.Regexp
+	scripts      []ScriptConfig
+	timeout      time.Duration
+	totalTimeout time.Duration
+	killTimeout  time.Duration
+	lockTimeout  time.Duration
+	retryDelay   time.Duration
+	retryMax     time.Duration
+	pauseBefore  time.Duration
+	pauseBetween time.Duration
+
+	timeoutByExtension map[string]time.Duration
+	sensitivePatterns  []*regexp.Regexp
+	groupIds           []uint32
+	minFreeSpace       uint64
+}
+
+// ScriptConfig is a script to run along with settings that override the
+// global ones for that script only.
+type ScriptConfig struct {
+	Path string
+
+	// Another name for Path, as steps call it.
+	Script string
+
+	// Commands run as a script of their own instead of Path, like the
+	// inline option.
+	Inline []string
+
+	// Overrides max_retries when set.
+	Retries *int
+
+	// Overrides timeout when set.
+	RawTimeout string `mapstructure:"timeout"`
+
+	// Environment variables added for just this script.
+	Vars []string `mapstructure:"environment_vars"`
+
+	// Overrides working_directory when set.
+	WorkingDirectory string `mapstructure:"working_directory"`
+
+	// Overrides valid_exit_codes when set.
+	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
+
+	timeout time.Duration
+}
+
+// MatrixEntry is a named set of environment variables the scripts are
+// run with when a matrix is configured.
+type MatrixEntry struct {
+	Name string
+	Vars []string `mapstructure:"environment_vars"`
+}
+
+var scratchSizeRe = regexp.MustCompile(`^[0-9]+[kKmMgG%]?$`)
+
+// scriptDownloadTimeout bounds how long downloading a remote script may
+// take.
+const scriptDownloadTimeout = 5 * time.Minute
+
+// sizeRe matches sizes such as "512M" or "10G", in bytes without a suffix.
+var sizeRe = regexp.MustCompile(`^([0-9]+)([kKmMgGtT]?)$`)
+
+// errFreeSpaceUnsupported is returned where free disk space can't be
+// checked.
+var errFreeSpaceUnsupported = errors.New("checking free disk space is not supported on this platform")
+
+// executeCommandData is the data available to execute_command. Script
+// and ArtifactFile are the names the shell provisioner uses for Path and
+// Artifact, while QuotedPath and QuotedArtifact are quoted for the shell.
+type executeCommandData struct {
+	Path           string
+	Script         string
+	QuotedPath     string
+	Vars           string
+	Artifact       string
+	ArtifactFile   string
+	QuotedArtifact string
+	ArtifactId     string
+	Args           string
+}
+
+// outputData is the data available to output.
+type outputData struct {
+	BuildName   string
+	BuilderType string
+}
+
+// artifactData is the data available to the inline commands, the
+// environment variables and the script paths, describing the artifact
+// being processed. ArtifactFiles are separated by spaces.
+type artifactData struct {
+	BuildName         string
+	BuilderType       string
+	ArtifactId        string
+	ArtifactBuilderId string
+	ArtifactString    string
+	ArtifactFiles     string
+}
+
+// captureOutputData is the data available to capture_output and
+// output_file.
+type captureOutputData struct {
+	ArtifactBase string
+	ArtifactDir  string
+	Script       string
+}
+
+// processTitleData is the data available to process_title_template.
+type processTitleData struct {
+	Script      string
+	Artifact    string
+	BuildName   string
+	BuilderType string
 }
 
 type PostProcessor struct {
 	config Config
+
+	// The PID file of the current run, if pid_file is set.
+	pidFile *pidFile
+
+	// When the scripts of the current run must be done by, if
+	// total_timeout is set.
+	deadline time.Time
+
+	// Whether the current run masks secrets and sensitive values, and the
+	// secrets it masks, wherever they're shown.
+	redacting bool
+	secrets   []string
+
+	// Holds a value for every script running, bounding them to
+	// global_max_parallel. Nil when there's no limit.
+	slots chan struct{}
+
+	// How many script runs have been traced, numbering the trace files.
+	traceCount int64
+
+	// Set once the scripts ran, for execution_scope "once".
+	ranOnce int32
+
+	// The ids of the artifacts processed successfully so far, for
+	// dedup_by_id.
+	seenIdsLock sync.Mutex
+	seenIds     map[string]bool
 }
 
 func (p *PostProcessor) Configure(raws ...interface{}) error {
-	err := config.Decode(&p.config, &config.DecodeOpts{
+	exclude := []string{
+		"capture_output",
+		"environment_vars",
+		"execute_command",
+		"extra_vars",
+		"inline",
+		"output",
+		"output_file",
+		"process_title_template",
+		"script",
+		"scripts",
+		"steps",
+	}
+
+	raws, err := addExtraVars(raws)
+	if err != nil {
+		return err
+	}
+
+	err = config.Decode(&p.config, &config.DecodeOpts{
 		Interpolate:        true,
 		InterpolateContext: &p.config.ctx,
 		InterpolateFilter: &interpolate.RenderFilter{
-			Exclude: []string{},
+			Exclude: exclude,
 		},
 	}, raws...)
+
+	// Decoding stops at the first template that fails to render, so the
+	// option is looked up in the raw configuration to still explain why.
+	// Like decoding, it's weakly typed and the last setting wins.
+	printInterp := false
+	for _, raw := range raws {
+		m, ok := rawMap(raw)
+		if !ok || m["print_interpolation"] == nil {
+			continue
+		}
+		if err := mapstructure.WeakDecode(m["print_interpolation"], &printInterp); err != nil {
+			printInterp = false
+		}
+	}
+	if printInterp {
+		printInterpolation(raws, &p.config.ctx, exclude)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -66,144 +773,3499 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 		p.config.Inline = nil
 	}
 
+	// execution_scope is another way of setting execute_mode
+	modeSet := p.config.ExecuteMode != ""
+	switch p.config.ExecutionScope {
+	case "file":
+		p.config.ExecuteMode = "per_file"
+	case "artifact", "once":
+		p.config.ExecuteMode = "once"
+	}
+
+	// use_powershell is a shorthand for shell
+	shellSet := len(p.config.Shell) > 0
+	if p.config.UsePowerShell && !shellSet {
+		p.config.Shell = powerShell()
+	} else if len(p.config.Shell) == 0 {
+		p.config.Shell = defaultShell()
+	}
+
+	executeCommandSet := p.config.ExecuteCommand != ""
+	// use_sudo is a shorthand for elevate_command
+	elevateSet := len(p.config.ElevateCommand) > 0
+	if p.config.UseSudo && !elevateSet {
+		p.config.ElevateCommand = []string{"sudo", "-n"}
+	}
+
+	if p.config.ExecuteCommand == "" {
+		// A batch is several paths, which must stay separate arguments
+		p.config.ExecuteCommand = p.defaultExecuteCommand(
+			p.config.BatchMaxBytes > 0 || p.config.ExecuteMode == "once")
+	}
+
+	if len(p.config.ValidExitCodes) == 0 {
+		p.config.ValidExitCodes = []int{0}
+	}
+
 	if p.config.InlineShebang == "" {
 		p.config.InlineShebang = "/bin/sh -e"
 	}
 
 	if p.config.Scripts == nil {
-		p.config.Scripts = make([]string, 0)
+		p.config.Scripts = make([]interface{}, 0)
 	}
 
-	if p.config.Vars == nil {
-		p.config.Vars = make([]string, 0)
+	if p.config.SkipClean == "" {
+		p.config.SkipClean = "never"
 	}
 
-	var errs *packer.MultiError
-	if p.config.Script != "" && len(p.config.Scripts) > 0 {
-		errs = packer.MultiErrorAppend(errs,
-			errors.New("Only one of script or scripts can be specified."))
+	if p.config.TraceOutput == "" {
+		p.config.TraceOutput = "."
 	}
 
-	if p.config.Script != "" {
-		p.config.Scripts = []string{p.config.Script}
+	if p.config.TimestampFormat == "" {
+		p.config.TimestampFormat = time.RFC3339
 	}
 
-	if len(p.config.Scripts) == 0 && p.config.Inline == nil {
-		errs = packer.MultiErrorAppend(errs,
-			errors.New("Either a script file or inline script must be specified."))
-	} else if len(p.config.Scripts) > 0 && p.config.Inline != nil {
-		errs = packer.MultiErrorAppend(errs,
-			errors.New("Only a script file or an inline script can be specified, not both."))
+	if p.config.ExecuteMode == "" {
+		p.config.ExecuteMode = "per_file"
 	}
 
-	for _, path := range p.config.Scripts {
-		if _, err := os.Stat(path); err != nil {
-			errs = packer.MultiErrorAppend(errs,
-				fmt.Errorf("Bad script '%s': %s", path, err))
-		}
+	// max_parallel is another way of setting parallel_jobs
+	jobsSet := p.config.ParallelJobs != 0
+	if p.config.MaxParallel > 1 && !jobsSet {
+		p.config.Parallel = true
+		p.config.ParallelJobs = p.config.MaxParallel
 	}
 
-	// Do a check for bad environment variables, such as '=foo', 'foobar'
-	for idx, kv := range p.config.Vars {
-		vs := strings.SplitN(kv, "=", 2)
-		if len(vs) != 2 || vs[0] == "" {
-			errs = packer.MultiErrorAppend(errs,
-				fmt.Errorf("Environment variable not in format 'key=value': %s", kv))
-		} else {
-			// Replace single quotes so they parse
-			vs[1] = strings.Replace(vs[1], "'", `'"'"'`, -1)
+	if p.config.ParallelJobs == 0 {
+		p.config.ParallelJobs = runtime.NumCPU()
+	}
 
-			// Single quote env var values
-			p.config.Vars[idx] = fmt.Sprintf("%s=%s", vs[0], vs[1])
-		}
+	if p.config.OutputOrder == "" {
+		p.config.OutputOrder = "interleaved"
 	}
 
-	if errs != nil && len(errs.Errors) > 0 {
-		return errs
+	if p.config.ArtifactSource == "" {
+		p.config.ArtifactSource = "files"
 	}
 
-	return nil
-}
+	stdinBehaviorSet := p.config.StdinBehavior != ""
+	if p.config.StdinBehavior == "" {
+		p.config.StdinBehavior = "close"
+	}
 
-func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	if p.config.ChangeDetection == "" {
+		p.config.ChangeDetection = "hash"
+	}
 
-	keep := p.config.KeepInputArtifact
+	cacheDirSet := p.config.CacheDir != ""
+	if p.config.CacheDir == "" {
+		p.config.CacheDir = defaultCacheDir()
+	}
 
-	scripts := make([]string, len(p.config.Scripts))
-	copy(scripts, p.config.Scripts)
+	checksumTypeSet := p.config.ChecksumType != ""
+	checksumTypesSet := len(p.config.ChecksumTypes) > 0
+	if p.config.ChecksumType == "" {
+		p.config.ChecksumType = "sha256"
+	}
+	if len(p.config.ChecksumTypes) == 0 {
+		p.config.ChecksumTypes = []string{p.config.ChecksumType}
+	}
 
-	// If we have an inline script, then turn that into a temporary
-	// shell script and use that.
-	if p.config.Inline != nil {
-		tf, err := ioutil.TempFile("", "packer-shell")
-		if err != nil {
-			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+	if p.config.OnFailure == "" {
+		p.config.OnFailure = "abort"
+		if p.config.CompensationScript != "" {
+			p.config.OnFailure = "cleanup_script"
 		}
-		defer os.Remove(tf.Name())
+	}
 
-		// Set the path to the temporary file
-		scripts = append(scripts, tf.Name())
+	if p.config.OutputArtifact == "" {
+		p.config.OutputArtifact = "replace"
+	}
 
-		// Write our contents to it
-		writer := bufio.NewWriter(tf)
-		writer.WriteString(fmt.Sprintf("#!%s\n", p.config.InlineShebang))
-		for _, command := range p.config.Inline {
-			if _, err := writer.WriteString(command + "\n"); err != nil {
-				return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
-			}
-		}
+	if p.config.OnNoScripts == "" {
+		p.config.OnNoScripts = "warn"
+	}
 
-		if err := writer.Flush(); err != nil {
-			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
-		}
+	if p.config.OutputLevel == "" {
+		p.config.OutputLevel = "normal"
+	}
 
-		tf.Close()
+	if p.config.OutputMode == "" {
+		p.config.OutputMode = "stream"
 	}
 
-	// Build our variables up by adding in the build name and builder type
-	envVars := make([]string, len(p.config.Vars)+2)
-	envVars[0] = fmt.Sprintf("PACKER_BUILD_NAME='%s'", p.config.PackerBuildName)
-	envVars[1] = fmt.Sprintf("PACKER_BUILDER_TYPE='%s'", p.config.PackerBuilderType)
-	copy(envVars[2:], p.config.Vars)
+	if p.config.OutputTruncation == "" {
+		p.config.OutputTruncation = "tail"
+	}
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
+	if p.config.Vars == nil {
+		p.config.Vars = make([]string, 0)
+	}
 
-	files := artifact.Files()
-	for _, art := range files {
-		for _, path := range scripts {
-			stdout.Reset()
-			stderr.Reset()
+	var errs *packer.MultiError
 
-			ui.Say(fmt.Sprintf("Processing with shell script: %s", path))
+	// The environment can turn a dry run on for a whole template without
+	// editing it, but not off.
+	if v := os.Getenv("PACKER_SHELL_DRY_RUN"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Invalid PACKER_SHELL_DRY_RUN '%s': %s", v, err))
+		}
+		p.config.DryRun = p.config.DryRun || dryRun
+	}
 
-			log.Printf("Opening %s for reading", path)
-			f, err := os.Open(path)
-			if err != nil {
-				return nil, false, fmt.Errorf("Error opening shell script: %s", err)
-			}
-			defer f.Close()
+	// Likewise CI can approve the scripts without anyone to ask
+	if v := os.Getenv("PACKER_SHELL_AUTO_APPROVE"); v != "" {
+		approve, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Invalid PACKER_SHELL_AUTO_APPROVE '%s': %s", v, err))
+		}
+		p.config.Confirm = p.config.Confirm && !approve
+	}
 
-			ui.Message(fmt.Sprintf("Executing script with artifact: %s", art))
-			command := strings.Join([]string{path, art}, " ")
-			log.Printf("Executing shell command: %s", command)
-			cmd := exec.Command("sh", "-c", command)
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			cmd.Env = append(os.Environ(), envVars...)
-			err = cmd.Run()
+	for url, pin := range p.config.ScriptChecksums {
+		if _, _, err := parseScriptChecksum(pin); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script_checksums entry for %s: %s", url, err))
+		}
+	}
 
-			stdoutString := strings.TrimSpace(stdout.String())
-			stderrString := strings.TrimSpace(stderr.String())
+	if len(p.config.Interpreter) > 0 && executeCommandSet {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of interpreter or execute_command can be specified."))
+	}
 
-			if err != nil {
-				return nil, false, fmt.Errorf("Error executing script: %s", stderrString)
-			}
+	if p.config.Script != "" && len(p.config.Scripts) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of script or scripts can be specified."))
+	}
 
-			log.Printf("stdout: %s", stdoutString)
-			log.Printf("stderr: %s", stderrString)
+	if p.config.Remote != nil {
+		for _, err := range p.config.Remote.prepare() {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+		if p.shellKind() != shellPosix {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("remote runs scripts with sh, so shell must be a POSIX shell"))
+		}
+		if p.config.TraceSyscalls || p.config.NetworkIsolation || p.config.ShellArgv0 != "" ||
+			len(p.config.SecretPipes) > 0 || len(p.config.ExtraFiles) > 0 || p.config.Pty {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("remote can't be combined with trace_syscalls, network_isolation, shell_argv0, secret_pipes, extra_files or pty"))
+		}
+		if p.config.Remote.UploadFiles && (p.config.ExecuteMode == "once" || p.config.BatchMaxBytes > 0) {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("remote upload_files can't be combined with execute_mode 'once' or batch_max_bytes"))
 		}
 	}
 
-	return artifact, keep, nil
+	// Only sh -c takes the operand after the command as $0
+	if p.config.ShellArgv0 != "" && p.shellKind() != shellPosix {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("shell_argv0 requires a POSIX shell"))
+	}
+
+	if p.config.UseSudo && elevateSet {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of use_sudo or elevate_command can be specified."))
+	}
+	if p.config.ExecuteAs != "" && len(p.config.ElevateCommand) == 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("execute_as requires use_sudo or elevate_command"))
+	}
+	if len(p.config.ElevateCommand) > 0 {
+		if p.config.Remote != nil || p.config.DockerImage != "" || p.config.ShellArgv0 != "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("use_sudo and elevate_command can't be combined with remote, docker_image or shell_argv0"))
+		}
+		if _, err := exec.LookPath(p.config.ElevateCommand[0]); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad elevate_command '%s': %s", p.config.ElevateCommand[0], err))
+		}
+		if len(p.config.SecretVars) > 0 && (p.config.StdinBehavior == "inherit" || p.config.Pty) {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("secret_vars are passed to use_sudo and elevate_command over stdin, so they can't be combined with stdin_behavior 'inherit' or pty"))
+		}
+	}
+
+	if p.config.DockerImage != "" {
+		if p.config.Remote != nil {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Only one of docker_image or remote can be specified."))
+		}
+		if p.shellKind() != shellPosix {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("docker_image runs scripts with sh, so shell must be a POSIX shell"))
+		}
+		if p.config.TraceSyscalls || p.config.NetworkIsolation || p.config.ShellArgv0 != "" ||
+			len(p.config.SecretPipes) > 0 || len(p.config.ExtraFiles) > 0 || p.config.Pty {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("docker_image can't be combined with trace_syscalls, network_isolation, shell_argv0, secret_pipes, extra_files or pty"))
+		}
+		if _, err := exec.LookPath("docker"); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("docker_image requires docker to be installed"))
+		}
+	} else if len(p.config.DockerVolumes) > 0 || len(p.config.DockerRunArgs) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("docker_volumes and docker_run_args require docker_image to be set"))
+	}
+
+	if p.config.EnvVarFormat != "" && strings.Count(p.config.EnvVarFormat, "%s") != 2 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("env_var_format must contain two %%s, for the name and the value: %s", p.config.EnvVarFormat))
+	}
+
+	if p.config.UsePowerShell && shellSet {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of use_powershell or shell can be specified."))
+	}
+
+	// steps is another way of giving scripts
+	if len(p.config.Steps) > 0 {
+		if p.config.Script != "" || len(p.config.Scripts) > 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Only one of script, scripts or steps can be specified."))
+		}
+		p.config.Scripts = p.config.Steps
+	}
+
+	if p.config.Script != "" {
+		p.config.Scripts = []interface{}{p.config.Script}
+	}
+
+	p.config.scripts = make([]ScriptConfig, 0, len(p.config.Scripts))
+	for _, raw := range p.config.Scripts {
+		script, err := decodeScript(raw)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+			continue
+		}
+		p.config.scripts = append(p.config.scripts, script)
+	}
+
+	if p.config.CompressionLevel == 0 {
+		p.config.CompressionLevel = gzip.DefaultCompression
+	} else if p.config.CompressionLevel < gzip.BestSpeed || p.config.CompressionLevel > gzip.BestCompression {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("compression_level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression))
+	}
+
+	if p.config.KeepOnFailure {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("keep_on_failure is deprecated and has no effect, as the input artifact is always kept when a script fails; remove it"))
+	}
+
+	switch p.config.Package {
+	case "":
+	case "tar.gz":
+		if p.config.OutputPath == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("package requires output to be set"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Unsupported package format: %s", p.config.Package))
+	}
+
+	switch p.config.OnFailure {
+	case "abort", "continue":
+	case "cleanup_script":
+		if p.config.CompensationScript == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("on_failure 'cleanup_script' requires compensation_script to be set"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("on_failure must be one of 'abort', 'continue' or 'cleanup_script': %s", p.config.OnFailure))
+	}
+
+	switch p.config.OutputArtifact {
+	case "replace":
+	case "supplement":
+		if p.config.OutputPath == "" || p.config.Package != "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("output_artifact 'supplement' requires output to be set without package"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("output_artifact must be one of 'replace' or 'supplement': %s", p.config.OutputArtifact))
+	}
+
+	switch p.config.OutputTruncation {
+	case "head", "tail":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("output_truncation must be one of 'head' or 'tail': %s", p.config.OutputTruncation))
+	}
+
+	if p.config.MaxOutputBytes < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("max_output_bytes must not be negative"))
+	}
+
+	if p.config.ParallelJobs < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("parallel_jobs must not be negative"))
+	}
+
+	if p.config.MaxParallel != 0 && jobsSet {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of max_parallel or parallel_jobs can be specified."))
+	}
+	if p.config.MaxParallel < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("max_parallel must not be negative"))
+	}
+
+	if p.config.GlobalMaxParallel < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("global_max_parallel must not be negative"))
+	} else if p.config.GlobalMaxParallel > 0 {
+		p.slots = make(chan struct{}, p.config.GlobalMaxParallel)
+	}
+
+	if p.config.LockName != "" && p.config.LockFile != "" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of lock_name or lock_file can be specified."))
+	}
+	if strings.ContainsAny(p.config.LockName, "/\\") {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Invalid lock_name: '%s'", p.config.LockName))
+	}
+
+	if p.config.RawLockTimeout != "" {
+		p.config.lockTimeout, err = time.ParseDuration(p.config.RawLockTimeout)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing lock_timeout: %s", err))
+		}
+		if p.config.LockName == "" && p.config.LockFile == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("lock_timeout requires lock_name or lock_file"))
+		}
+	}
+
+	if p.config.BatchMaxBytes < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("batch_max_bytes must not be negative"))
+	}
+
+	if p.config.BatchMaxBytes > 0 && (p.config.ReadOnly || p.config.ComputeChecksum) {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("batch_max_bytes can't be combined with read_only or compute_checksum"))
+	}
+
+	switch p.config.ExecutionScope {
+	case "", "file", "artifact", "once":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("execution_scope must be one of 'file', 'artifact' or 'once': %s", p.config.ExecutionScope))
+	}
+	if p.config.ExecutionScope != "" && modeSet {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of execution_scope or execute_mode can be specified."))
+	}
+
+	switch p.config.ExecuteMode {
+	case "per_file":
+	case "once":
+		if p.config.BatchMaxBytes > 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("execute_mode 'once' can't be combined with batch_max_bytes"))
+		}
+		if p.config.ReadOnly || p.config.ComputeChecksum {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("execute_mode 'once' can't be combined with read_only or compute_checksum"))
+		}
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("execute_mode must be one of 'per_file' or 'once': %s", p.config.ExecuteMode))
+	}
+
+	if p.config.SideEffectOnly && p.config.OutputPath != "" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("side_effect_only can't be combined with output"))
+	}
+
+	if p.config.DiscardArtifact && (p.config.SideEffectOnly || p.config.KeepInputArtifact ||
+		p.config.OutputPath != "" || p.config.Package != "") {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("discard_artifact can't be combined with side_effect_only, keep_input_artifact, output or package"))
+	}
+
+	hasScripts := len(p.config.Scripts) > 0 || p.config.ScriptsDir != ""
+	if !hasScripts && p.config.Inline == nil {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Either a script file or inline script must be specified."))
+	} else if hasScripts && p.config.Inline != nil {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only a script file or an inline script can be specified, not both."))
+	}
+
+	if _, ok := checksumTypes[p.config.ChecksumType]; !ok {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Unsupported checksum_type: %s", p.config.ChecksumType))
+	}
+
+	if checksumTypeSet && checksumTypesSet {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of checksum_type or checksum_types can be specified."))
+	}
+	for _, t := range p.config.ChecksumTypes {
+		if _, ok := checksumTypes[t]; !ok {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Unsupported checksum_types entry: %s", t))
+		}
+	}
+
+	if (p.config.ChecksumFile || p.config.ChecksumState) && !p.config.ComputeChecksum {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("checksum_file and checksum_state require compute_checksum"))
+	}
+
+	if p.config.ArtifactSource != "files" &&
+		(!strings.HasPrefix(p.config.ArtifactSource, "state:") || p.config.ArtifactSource == "state:") {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("artifact_source must be 'files' or 'state:<key>': %s", p.config.ArtifactSource))
+	}
+
+	if p.config.SkipIfUnchanged &&
+		(p.config.OutputPath != "" || p.config.Package != "" || p.config.DiscardArtifact) {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("skip_if_unchanged can't be combined with output, package or discard_artifact"))
+	}
+
+	if cacheDirSet && !p.config.SkipIfUnchanged {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("cache_dir requires skip_if_unchanged"))
+	}
+
+	if _, ok := changeDetectors[p.config.ChangeDetection]; !ok {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("change_detection must be one of 'hash', 'mtime' or 'size': %s", p.config.ChangeDetection))
+	}
+
+	switch p.config.OutputOrder {
+	case "interleaved", "grouped":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("output_order must be one of 'interleaved' or 'grouped': %s", p.config.OutputOrder))
+	}
+
+	switch p.config.StdinBehavior {
+	case "close", "null", "inherit":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("stdin_behavior must be one of 'close', 'null' or 'inherit': %s", p.config.StdinBehavior))
+	}
+
+	if stdinBehaviorSet && (p.config.Stdin != "" || p.config.StdinFile != "") {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("stdin_behavior can't be combined with stdin or stdin_file"))
+	}
+	if p.config.Stdin != "" && p.config.StdinFile != "" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of stdin or stdin_file can be specified."))
+	}
+	if p.config.StdinFile != "" {
+		if _, err := os.Stat(p.config.StdinFile); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad stdin_file '%s': %s", p.config.StdinFile, err))
+		}
+	}
+
+	if p.config.Pty && runtime.GOOS != "linux" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("pty is only supported on Linux"))
+	}
+
+	switch p.config.OnNoScripts {
+	case "error", "warn", "skip":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("on_no_scripts must be one of 'error', 'warn' or 'skip': %s", p.config.OnNoScripts))
+	}
+
+	switch p.config.OutputLevel {
+	case "quiet", "normal", "verbose":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("output_level must be one of 'quiet', 'normal' or 'verbose': %s", p.config.OutputLevel))
+	}
+
+	switch p.config.OutputMode {
+	case "stream", "buffered":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("output_mode must be one of 'stream' or 'buffered': %s", p.config.OutputMode))
+	}
+
+	hookScripts := []string{p.config.SetupScript, p.config.TeardownScript, p.config.CompensationScript}
+	hookScripts = append(hookScripts, p.config.BeforeScripts...)
+	hookScripts = append(hookScripts, p.config.AfterScripts...)
+	hookScripts = append(hookScripts, p.config.ErrorScripts...)
+	for _, path := range hookScripts {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script '%s': %s", path, err))
+		}
+	}
+
+	if p.config.ScriptsDir != "" {
+		if fi, err := os.Stat(p.config.ScriptsDir); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad scripts_dir '%s': %s", p.config.ScriptsDir, err))
+		} else if !fi.IsDir() {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("scripts_dir is not a directory: %s", p.config.ScriptsDir))
+		}
+	}
+
+	if p.config.ScriptsDirPattern != "" {
+		if _, err := filepath.Match(p.config.ScriptsDirPattern, ""); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad scripts_dir_pattern '%s': %s", p.config.ScriptsDirPattern, err))
+		}
+	}
+
+	switch p.config.SkipClean {
+	case "always", "never", "on_failure":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("skip_clean must be one of 'always', 'never' or 'on_failure': %s", p.config.SkipClean))
+	}
+
+	if p.config.ExpectOutput != "" && p.config.ExpectStdoutRegex != "" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of expect_output or expect_stdout_regex can be specified."))
+	}
+	if p.config.ExpectStdoutRegex == "" {
+		p.config.ExpectStdoutRegex = p.config.ExpectOutput
+	}
+
+	for _, re := range []struct {
+		name    string
+		pattern string
+		regexp  **regexp.Regexp
+	}{
+		{"expect_stdout_regex", p.config.ExpectStdoutRegex, &p.config.expectOutput},
+		{"expect_stderr_regex", p.config.ExpectStderrRegex, &p.config.expectStderr},
+		{"fail_stdout_regex", p.config.FailStdoutRegex, &p.config.failStdout},
+		{"fail_stderr_regex", p.config.FailStderrRegex, &p.config.failStderr},
+	} {
+		if re.pattern == "" {
+			continue
+		}
+		*re.regexp, err = regexp.Compile(re.pattern)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error compiling %s: %s", re.name, err))
+		}
+	}
+
+	if len(p.config.OnlyBuilderIds) > 0 && len(p.config.ExceptBuilderIds) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of only_builder_ids or except_builder_ids can be specified."))
+	}
+
+	if len(p.config.OnlyBuilderTypes) > 0 && len(p.config.ExceptBuilderTypes) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of only_builder_types or except_builder_types can be specified."))
+	}
+
+	if len(p.config.OnlyBuildNames) > 0 && len(p.config.ExceptBuildNames) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of only_build_names or except_build_names can be specified."))
+	}
+
+	for _, patterns := range [][]string{
+		p.config.OnlyBuilderTypes, p.config.ExceptBuilderTypes,
+		p.config.OnlyBuildNames, p.config.ExceptBuildNames,
+	} {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Bad builder type or build name pattern '%s': %s", pattern, err))
+			}
+		}
+	}
+
+	if len(p.config.ForwardMachineFields) > 0 && p.config.MachineReadableFile == "" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("forward_machine_fields requires machine_readable_file"))
+	}
+
+	if p.config.MinFreeSpace != "" {
+		var err error
+		p.config.minFreeSpace, err = parseSize(p.config.MinFreeSpace)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Invalid min_free_space: %s", err))
+		}
+	}
+
+	if p.config.ScratchSize != "" && !scratchSizeRe.MatchString(p.config.ScratchSize) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Invalid scratch_size: %s", p.config.ScratchSize))
+	}
+
+	if p.config.WorkingDirectory != "" {
+		if fi, err := os.Stat(p.config.WorkingDirectory); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad working_directory '%s': %s", p.config.WorkingDirectory, err))
+		} else if !fi.IsDir() {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("working_directory '%s' is not a directory", p.config.WorkingDirectory))
+		}
+	}
+
+	if p.config.TmpDir != "" {
+		if err := checkWritableDir(p.config.TmpDir); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad tmp_dir '%s': %s", p.config.TmpDir, err))
+		}
+	}
+
+	if p.config.TempDir == "" {
+		p.config.TempDir = p.config.TmpDir
+	} else if err := checkWritableDir(p.config.TempDir); err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Bad temp_dir '%s': %s", p.config.TempDir, err))
+	}
+
+	if p.config.TraceSyscalls {
+		if tracer == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("trace_syscalls is only supported on Linux and macOS"))
+		} else if _, err := exec.LookPath(tracer); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("trace_syscalls requires %s, which was not found: %s", tracer, err))
+		}
+	}
+
+	if p.config.NetworkIsolation {
+		if runtime.GOOS != "linux" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("network_isolation is only supported on Linux"))
+		} else if os.Geteuid() != 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("network_isolation requires running Packer as root"))
+		}
+	}
+
+	if _, err := p.executeCommand("script.sh", nil, "artifact"); err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Error processing execute_command: %s", err))
+	}
+
+	if p.config.OutputPath != "" {
+		if _, err := p.outputPath(); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error processing output: %s", err))
+		}
+	}
+
+	if p.config.CaptureOutput != "" {
+		if _, err := p.captureOutputPath("script.sh", "artifact"); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error processing capture_output: %s", err))
+		}
+	}
+
+	if p.config.ProcessTitleTemplate != "" {
+		if _, err := p.processTitle("script.sh", "artifact"); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error processing process_title_template: %s", err))
+		}
+	}
+
+	if len(p.config.ExtraFiles) > 0 && runtime.GOOS == "windows" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("extra_files is not supported on Windows"))
+	}
+
+	for _, path := range p.config.ExtraFiles {
+		if _, err := os.Stat(path); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad extra file '%s': %s", path, err))
+		}
+	}
+
+	if len(p.config.Groups) > 0 && runtime.GOOS == "windows" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("groups is not supported on Windows"))
+	}
+
+	p.config.groupIds = make([]uint32, 0, len(p.config.Groups))
+	for _, group := range p.config.Groups {
+		gid, err := lookupGroupId(group)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad group '%s': %s", group, err))
+			continue
+		}
+		p.config.groupIds = append(p.config.groupIds, gid)
+	}
+
+	if p.config.MaxRetries < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("max_retries must not be negative"))
+	}
+
+	if p.config.RetryBackoff == 0 {
+		p.config.RetryBackoff = 1
+	}
+	if p.config.RetryBackoff < 1 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("retry_backoff must be at least 1"))
+	}
+
+	if p.config.RawRetryMaxDelay != "" {
+		p.config.retryMax, err = time.ParseDuration(p.config.RawRetryMaxDelay)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing retry_max_delay: %s", err))
+		}
+	}
+
+	if p.config.RawTimeout != "" {
+		p.config.timeout, err = time.ParseDuration(p.config.RawTimeout)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing timeout: %s", err))
+		}
+	}
+
+	if p.config.RawTotalTimeout != "" {
+		p.config.totalTimeout, err = time.ParseDuration(p.config.RawTotalTimeout)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing total_timeout: %s", err))
+		}
+	}
+
+	if p.config.RawKillTimeout == "" {
+		p.config.RawKillTimeout = "10s"
+	}
+	p.config.killTimeout, err = time.ParseDuration(p.config.RawKillTimeout)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Failed parsing kill_timeout: %s", err))
+	}
+
+	if p.config.RawRetryDelay != "" {
+		p.config.retryDelay, err = time.ParseDuration(p.config.RawRetryDelay)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing retry_delay: %s", err))
+		}
+	}
+
+	if p.config.RawPauseBefore != "" {
+		p.config.pauseBefore, err = time.ParseDuration(p.config.RawPauseBefore)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing pause_before: %s", err))
+		}
+	}
+
+	if p.config.RawPauseBetween != "" {
+		p.config.pauseBetween, err = time.ParseDuration(p.config.RawPauseBetween)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing pause_between: %s", err))
+		}
+	}
+
+	p.config.timeoutByExtension = make(map[string]time.Duration)
+	for ext, raw := range p.config.RawTimeoutByExtension {
+		timeout, err := time.ParseDuration(raw)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing timeout_by_extension for '%s': %s", ext, err))
+			continue
+		}
+		p.config.timeoutByExtension[normalizeExtension(ext)] = timeout
+	}
+
+	for _, script := range p.config.scripts {
+		if script.WorkingDirectory != "" && !strings.Contains(script.WorkingDirectory, "{{") {
+			if fi, err := os.Stat(script.WorkingDirectory); err != nil {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Bad working_directory '%s': %s", script.WorkingDirectory, err))
+			} else if !fi.IsDir() {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("working_directory '%s' is not a directory", script.WorkingDirectory))
+			}
+		}
+
+		// Templated paths are only known once there's an artifact
+		if script.Path == "" || isURL(script.Path) || strings.Contains(script.Path, "{{") {
+			continue
+		}
+		if _, err := os.Stat(script.Path); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script '%s': %s", script.Path, err))
+		}
+	}
+
+	// Do a check for bad environment variables, such as '=foo', 'foobar'
+	for _, err := range processEnvVars(p.config.Vars) {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	if p.config.EnvVarsFile != "" {
+		if _, err := readEnvFile(p.config.EnvVarsFile); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad environment_vars_file '%s': %s", p.config.EnvVarsFile, err))
+		}
+	}
+
+	for _, pattern := range p.config.PassEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad pass_env pattern '%s': %s", pattern, err))
+		}
+	}
+
+	for _, kv := range p.config.DynamicVars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) != 2 || vs[0] == "" || vs[1] == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Dynamic environment variable not in format 'key=command': %s", kv))
+		}
+	}
+
+	for _, err := range processEnvVars(p.config.PreconditionVars) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("precondition_environment_vars: %s", err))
+	}
+
+	if len(p.config.SecretPipes) > 0 && runtime.GOOS == "windows" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("secret_pipes is not supported on Windows"))
+	}
+
+	for name := range p.config.SecretPipes {
+		if name == "" || strings.ContainsAny(name, "=/\\") {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Invalid secret_pipes name: '%s'", name))
+		}
+	}
+
+	for _, pattern := range p.config.SensitiveVars {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad sensitive_vars pattern '%s': %s", pattern, err))
+		}
+	}
+
+	for _, pattern := range p.config.SensitivePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error compiling sensitive_patterns: %s", err))
+			continue
+		}
+		p.config.sensitivePatterns = append(p.config.sensitivePatterns, re)
+	}
+
+	for name, source := range p.config.SecretVars {
+		if name == "" || strings.Contains(name, "=") {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Invalid secret_vars name: '%s'", name))
+		}
+		if _, _, err := parseSecretSource(source); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad secret_vars source for %s: %s", name, err))
+		}
+	}
+
+	matrixNames := make(map[string]bool)
+	for i, entry := range p.config.Matrix {
+		if entry.Name == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Matrix entry %d must have a name", i))
+		} else if matrixNames[entry.Name] {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Duplicate matrix entry name: %s", entry.Name))
+		}
+		matrixNames[entry.Name] = true
+
+		for _, err := range processEnvVars(entry.Vars) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Matrix entry '%s': %s", entry.Name, err))
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	watchInterrupts()
+
+	if p.config.OutputLevel == "quiet" {
+		ui = &quietUi{ui}
+	}
+
+	logOutput := log.Writer()
+	result, keep, err := p.postProcess(ui, artifact)
+	if p.redacting {
+		if err != nil {
+			err = errors.New(p.redact(err.Error()))
+		}
+		log.SetOutput(logOutput)
+		p.redacting = false
+		p.secrets = nil
+	}
+
+	// A side effect never transforms the artifact, whatever happened
+	if p.config.SideEffectOnly {
+		return artifact, true, err
+	}
+
+	// Whatever keep_input_artifact says, the input is never thrown away
+	// after a failure, when it's needed the most to find out why.
+	if err != nil {
+		ui.Message("Keeping input artifact after failure")
+		return artifact, true, err
+	}
+
+	return result, keep, err
+}
+
+// skipArtifact passes the artifact on unchanged without running any
+// script, saying why. With junit_report its files, or its id if it has
+// none, are reported as skipped.
+func (p *PostProcessor) skipArtifact(ui packer.Ui, artifact packer.Artifact, reason string) (packer.Artifact, bool, error) {
+	ui.Say(reason)
+	if p.config.JUnitReport == "" {
+		return artifact, true, nil
+	}
+
+	files := artifact.Files()
+	if len(files) == 0 {
+		files = []string{artifact.Id()}
+	}
+	results := make([]scriptResult, len(files))
+	for i, file := range files {
+		results[i] = scriptResult{File: file, Skipped: true, SkipReason: reason}
+	}
+
+	ui.Message(fmt.Sprintf("Writing JUnit report: %s", p.config.JUnitReport))
+	if err := writeJUnitReport(p.config.JUnitReport, p.config.PackerBuildName, results); err != nil {
+		return nil, false, fmt.Errorf("Error writing JUnit report: %s", err)
+	}
+	return artifact, true, nil
+}
+
+func (p *PostProcessor) postProcess(ui packer.Ui, artifact packer.Artifact) (result packer.Artifact, resultKeep bool, err error) {
+
+	keep := p.config.KeepInputArtifact
+
+	if !p.builderIdAllowed(artifact.BuilderId()) {
+		return p.skipArtifact(ui, artifact, fmt.Sprintf("Skipping artifact from builder: %s", artifact.BuilderId()))
+	}
+
+	if !p.buildAllowed() {
+		return p.skipArtifact(ui, artifact,
+			fmt.Sprintf("Skipping artifact of build %s (%s)", p.config.PackerBuildName, p.config.PackerBuilderType))
+	}
+
+	if p.config.DedupById && p.seen(artifact.Id()) {
+		return p.skipArtifact(ui, artifact, fmt.Sprintf("Skipping already processed artifact: %s", artifact.Id()))
+	}
+
+	if p.config.ExecutionScope == "once" && !atomic.CompareAndSwapInt32(&p.ranOnce, 0, 1) {
+		return p.skipArtifact(ui, artifact, "Scripts already ran for an earlier artifact, skipping")
+	}
+
+	if p.config.PidFile != "" {
+		p.pidFile, err = createPidFile(p.config.PidFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error writing PID file: %s", err)
+		}
+		defer func() {
+			if err := p.pidFile.Remove(); err != nil {
+				log.Printf("Error removing PID file: %s", err)
+			}
+			p.pidFile = nil
+		}()
+	}
+
+	if p.config.totalTimeout > 0 {
+		p.deadline = time.Now().Add(p.config.totalTimeout)
+		defer func() { p.deadline = time.Time{} }()
+	}
+
+	// Every temporary file we create is recorded here so that it can be
+	// cleaned up according to skip_clean once we know the outcome.
+	var tempFiles []string
+	results := &runResults{keepAll: p.keepsOutput()}
+
+	// An artifact whose scripts failed is processed again when it's back
+	if p.config.DedupById {
+		defer func() {
+			if err == nil && !results.failed() {
+				p.markSeen(artifact.Id())
+			}
+		}()
+	}
+
+	defer func() {
+		if err != nil {
+			results.reportFailures(ui)
+		}
+
+		if p.config.CaptureOutput != "" {
+			captureErr := p.writeCapturedOutput(results.all())
+			if captureErr != nil && err == nil {
+				err = fmt.Errorf("Error writing captured output: %s", captureErr)
+			}
+		}
+
+		if p.config.JUnitReport != "" {
+			ui.Message(fmt.Sprintf("Writing JUnit report: %s", p.config.JUnitReport))
+			reportErr := writeJUnitReport(p.config.JUnitReport, p.config.PackerBuildName, results.all())
+			if reportErr != nil && err == nil {
+				err = fmt.Errorf("Error writing JUnit report: %s", reportErr)
+			}
+		}
+
+		if p.config.MarkdownReport != "" {
+			ui.Message(fmt.Sprintf("Writing Markdown report: %s", p.config.MarkdownReport))
+			reportErr := writeMarkdownReport(p.config.MarkdownReport, p.config.PackerBuildName, results.all())
+			if reportErr != nil && err == nil {
+				err = fmt.Errorf("Error writing Markdown report: %s", reportErr)
+			}
+		}
+
+		if p.config.ExecutionLog != "" {
+			logErr := appendExecutionLog(p.config.ExecutionLog, p.config.PackerBuildName, results.all(), p.redact)
+			if logErr != nil && err == nil {
+				err = fmt.Errorf("Error writing execution log: %s", logErr)
+			}
+		}
+
+		// Nothing is left behind for debugging a run that was interrupted
+		p.cleanTempFiles(ui, tempFiles, err != nil && !isInterrupted())
+	}()
+
+	ctx := p.config.ctx
+	ctx.Data = &artifactData{
+		BuildName:         p.config.PackerBuildName,
+		BuilderType:       p.config.PackerBuilderType,
+		ArtifactId:        artifact.Id(),
+		ArtifactBuilderId: artifact.BuilderId(),
+		ArtifactString:    artifact.String(),
+		ArtifactFiles:     strings.Join(artifact.Files(), " "),
+	}
+
+	scripts := make([]ScriptConfig, len(p.config.scripts))
+	copy(scripts, p.config.scripts)
+	for i, script := range scripts {
+		if scripts[i].Path, err = interpolate.Render(script.Path, &ctx); err != nil {
+			return nil, false, fmt.Errorf("Error processing script path %s: %s", script.Path, err)
+		}
+		if scripts[i].WorkingDirectory, err = interpolate.Render(script.WorkingDirectory, &ctx); err != nil {
+			return nil, false, fmt.Errorf("Error processing working_directory %s: %s", script.WorkingDirectory, err)
+		}
+
+		scripts[i].Vars = make([]string, len(script.Vars))
+		for j, kv := range script.Vars {
+			if scripts[i].Vars[j], err = interpolate.Render(kv, &ctx); err != nil {
+				return nil, false, fmt.Errorf("Error processing environment variable %s: %s", kv, err)
+			}
+		}
+	}
+
+	// Remote scripts are downloaded, to temporary files or the cache, and
+	// run from there
+	for i, script := range scripts {
+		if !isURL(script.Path) {
+			continue
+		}
+
+		path, temp, err := p.fetchScript(ui, script.Path)
+		if temp && path != "" {
+			tempFiles = append(tempFiles, path)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("Error downloading script %s: %s", script.Path, err)
+		}
+		scripts[i].Path = path
+	}
+
+	if p.config.ScriptsDir != "" {
+		dirScripts, err := p.discoverScripts()
+		if err != nil {
+			return nil, false, err
+		}
+		scripts = append(scripts, dirScripts...)
+	}
+
+	// Inline steps are written to temporary scripts of their own
+	for i, script := range scripts {
+		if len(script.Inline) == 0 {
+			continue
+		}
+
+		path, err := p.writeInlineScript(script.Inline, &ctx)
+		if path != "" && !p.config.DryRun {
+			tempFiles = append(tempFiles, path)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		scripts[i].Path = path
+	}
+
+	// If we have an inline script, then turn that into a temporary
+	// shell script and use that.
+	var inline string
+	if p.config.Inline != nil {
+		inline, err = p.writeInlineScript(p.config.Inline, &ctx)
+
+		// A dry run leaves the script behind to be inspected
+		if inline != "" && !p.config.DryRun {
+			tempFiles = append(tempFiles, inline)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Set the path to the temporary file
+		scripts = append(scripts, ScriptConfig{Path: inline})
+	}
+
+	if len(scripts) == 0 {
+		switch p.config.OnNoScripts {
+		case "error":
+			return nil, false, errors.New("No scripts to run")
+		case "warn":
+			ui.Error("Warning: no scripts to run, skipping shell post-processor")
+		default:
+			log.Printf("No scripts to run, skipping")
+		}
+		return artifact, true, nil
+	}
+
+	var output string
+	if p.config.OutputPath != "" {
+		if output, err = p.outputPath(); err != nil {
+			return nil, false, fmt.Errorf("Error processing output: %s", err)
+		}
+	}
+
+	// Build our variables up by adding in the build name and builder type,
+	// and a timestamp taken once so that every script sees the same one
+	now := time.Now().UTC()
+	envVars := make([]string, 0, len(p.config.Vars)+10)
+	envVars = append(envVars,
+		fmt.Sprintf("PACKER_BUILD_NAME=%s", p.config.PackerBuildName),
+		fmt.Sprintf("PACKER_BUILDER_TYPE=%s", p.config.PackerBuilderType),
+		fmt.Sprintf("PACKER_BUILD_TIMESTAMP=%s", now.Format(p.config.TimestampFormat)),
+		fmt.Sprintf("PACKER_BUILD_EPOCH=%d", now.Unix()),
+		fmt.Sprintf("PACKER_ARTIFACT_ID=%s", artifact.Id()),
+		fmt.Sprintf("PACKER_ARTIFACT_BUILDER_ID=%s", artifact.BuilderId()),
+		fmt.Sprintf("PACKER_ARTIFACT_STRING=%s", artifact.String()))
+	baseVarCount := len(envVars)
+
+	// Later variables override earlier ones, so the passed environment
+	// comes first and the file's variables after it, leaving everything
+	// below to take precedence.
+	envVars = append(envVars, passedEnv(p.config.PassEnv)...)
+	if p.config.EnvVarsFile != "" {
+		fileVars, err := readEnvFile(p.config.EnvVarsFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error reading environment_vars_file: %s", err)
+		}
+		envVars = append(envVars, fileVars...)
+	}
+
+	// The locale overrides the inherited one, but not any locale the user
+	// explicitly set in environment_vars.
+	if p.config.Locale != "" {
+		envVars = append(envVars,
+			fmt.Sprintf("LC_ALL=%s", p.config.Locale),
+			fmt.Sprintf("LANG=%s", p.config.Locale))
+	}
+
+	if p.config.TmpDir != "" {
+		envVars = append(envVars, fmt.Sprintf("TMPDIR=%s", p.config.TmpDir))
+		if runtime.GOOS == "windows" {
+			envVars = append(envVars,
+				fmt.Sprintf("TEMP=%s", p.config.TmpDir),
+				fmt.Sprintf("TMP=%s", p.config.TmpDir))
+		}
+	}
+
+	if len(p.config.ForwardMachineFields) > 0 {
+		fields, err := readMachineFields(
+			p.config.MachineReadableFile, p.config.PackerBuildName, p.config.ForwardMachineFields)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error reading machine-readable output: %s", err)
+		}
+
+		for _, t := range p.config.ForwardMachineFields {
+			if value, ok := fields[t]; ok {
+				envVars = append(envVars, machineFieldEnv(t, value))
+			} else {
+				log.Printf("No machine-readable '%s' message to forward", t)
+			}
+		}
+	}
+
+	for _, kv := range p.config.Vars {
+		rendered, err := interpolate.Render(kv, &ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error processing environment variable %s: %s", kv, err)
+		}
+		envVars = append(envVars, rendered)
+	}
+
+	var secrets []string
+	if len(p.config.SecretVars) > 0 {
+		secretVars, fetched, err := p.fetchSecretVars()
+		if err != nil {
+			return nil, false, err
+		}
+		envVars = append(envVars, secretVars...)
+		secrets = append(secrets, fetched...)
+	}
+
+	if len(p.config.DynamicVars) > 0 {
+		dynamicVars, err := p.evalDynamicVars(envVars)
+		if err != nil {
+			return nil, false, err
+		}
+		envVars = append(envVars, dynamicVars...)
+	}
+
+	// Secrets and sensitive values are masked from here on, until
+	// PostProcess returns
+	for _, secret := range p.config.SecretPipes {
+		secrets = append(secrets, secret)
+	}
+	secrets = append(secrets, p.sensitiveValues(envVars, scripts)...)
+	if len(secrets) > 0 || len(p.config.sensitivePatterns) > 0 {
+		p.redacting = true
+		p.secrets = secrets
+		ui = &redactUi{ui: ui, redact: p.redact}
+		log.SetOutput(&redactWriter{w: log.Writer(), redact: p.redact})
+	}
+
+	// What skip_if_unchanged compares, leaving out the build timestamp and
+	// the paths of temporary files added below.
+	configuredVars := envVars[baseVarCount:]
+
+	if p.config.ExposeConfig {
+		configJSON, err := p.configJSON()
+		if err != nil {
+			return nil, false, fmt.Errorf("Error serializing config: %s", err)
+		}
+		envVars = append(envVars, fmt.Sprintf("PACKER_SHELL_CONFIG_JSON=%s", configJSON))
+	}
+
+	if p.config.ScratchDir {
+		dir, mounted, err := p.createScratchDir(ui)
+		if err != nil {
+			return nil, false, err
+		}
+		tempFiles = append(tempFiles, dir)
+		if mounted {
+			defer func() {
+				log.Printf("Unmounting scratch directory: %s", dir)
+				if err := unmountTmpfs(dir); err != nil {
+					ui.Error(fmt.Sprintf("Error unmounting scratch directory %s: %s", dir, err))
+				}
+			}()
+		}
+
+		envVars = append(envVars, fmt.Sprintf("PACKER_SCRATCH_DIR=%s", dir))
+	}
+
+	// Scripts producing output need to know where it goes
+	if output != "" && p.config.Package == "" {
+		envVars = append(envVars, fmt.Sprintf("PACKER_SHELL_OUTPUT=%s", output))
+
+		// A trailing separator asks for a directory to write files into
+		if os.IsPathSeparator(output[len(output)-1]) {
+			if err := os.MkdirAll(output, 0755); err != nil {
+				return nil, false, fmt.Errorf("Error creating output directory: %s", err)
+			}
+		}
+	}
+
+	if p.config.WriteArtifactManifest {
+		path, err := writeArtifactManifest(p.config.TmpDir, artifact, p.config.ArtifactManifestState)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error writing artifact manifest: %s", err)
+		}
+		tempFiles = append(tempFiles, path)
+		envVars = append(envVars, fmt.Sprintf("PACKER_ARTIFACT_MANIFEST=%s", path))
+	}
+
+	// The scripts can override keep_input_artifact by writing true or
+	// false to this file.
+	keepFile, err := p.createEmptyFile("packer-shell-keep")
+	if err != nil {
+		return nil, false, fmt.Errorf("Error creating keep artifact file: %s", err)
+	}
+	tempFiles = append(tempFiles, keepFile)
+	envVars = append(envVars, fmt.Sprintf("PACKER_KEEP_ARTIFACT=%s", keepFile))
+
+	// The scripts can replace the artifact by writing the paths of its new
+	// files to this one.
+	resultFile, err := p.createEmptyFile("packer-shell-result")
+	if err != nil {
+		return nil, false, fmt.Errorf("Error creating result file: %s", err)
+	}
+	tempFiles = append(tempFiles, resultFile)
+	envVars = append(envVars, fmt.Sprintf("PACKER_RESULT_FILE=%s", resultFile))
+
+	// And add to the state of the returned artifact by writing key=value
+	// lines to this one, for later post-processors.
+	stateFile, err := p.createEmptyFile("packer-shell-state")
+	if err != nil {
+		return nil, false, fmt.Errorf("Error creating state file: %s", err)
+	}
+	tempFiles = append(tempFiles, stateFile)
+	envVars = append(envVars, fmt.Sprintf("PACKER_STATE_FILE=%s", stateFile))
+
+	if p.config.EnvFile {
+		path, err := p.writeEnvFile(envVars)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error writing env_file: %s", err)
+		}
+		tempFiles = append(tempFiles, path)
+		envVars = append(envVars, fmt.Sprintf("PACKER_SHELL_ENV_FILE=%s", path))
+	}
+
+	if p.config.MinFreeSpace != "" {
+		if err := p.checkFreeSpace(ui, output); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if p.config.Precondition != "" && p.config.DryRun {
+		ui.Say(fmt.Sprintf("Dry run, would check precondition: %s", p.config.Precondition))
+	} else if p.config.Precondition != "" {
+		ok, err := p.checkPrecondition(ui, envVars)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			ui.Say("Precondition not met, skipping shell scripts")
+			return artifact, true, nil
+		}
+	}
+
+	files, err := p.artifactFiles(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Artifacts such as AMIs have no files. Only execute_mode "once" can
+	// run scripts without any, so otherwise make it clear nothing ran.
+	if len(files) == 0 && p.config.ExecuteMode != "once" {
+		ui.Say("Artifact has no files, skipping shell scripts (set execute_mode to 'once' to run them anyway)")
+		return artifact, true, nil
+	}
+
+	// Relative paths would no longer point at the files from the working
+	// directory.
+	if p.changesDirectory() {
+		for i, file := range files {
+			if files[i], err = filepath.Abs(file); err != nil {
+				return nil, false, fmt.Errorf("Error resolving artifact file %s: %s", file, err)
+			}
+		}
+	}
+
+	if p.config.Reverse {
+		reversed := make([]string, len(files))
+		for i, file := range files {
+			reversed[len(files)-1-i] = file
+		}
+		files = reversed
+	}
+
+	// What each script invocation is given: a single file, or with
+	// batch_max_bytes or execute_mode "once" a space separated batch of
+	// them.
+	envVars = append(envVars, fmt.Sprintf("PACKER_ARTIFACT_FILES=%s", strings.Join(files, "\n")))
+	targets := files
+	if p.config.ExecuteMode == "once" {
+		targets = []string{p.joinFiles(files)}
+	} else if p.config.BatchMaxBytes > 0 {
+		batches, err := batchFiles(ui, files, p.config.BatchMaxBytes)
+		if err != nil {
+			return nil, false, err
+		}
+		targets = make([]string, len(batches))
+		for i, batch := range batches {
+			targets[i] = p.joinFiles(batch)
+		}
+	}
+
+	if p.config.DryRun {
+		if err := p.dryRun(ui, scripts, targets, envVars, inline); err != nil {
+			return nil, false, err
+		}
+		return artifact, true, nil
+	}
+
+	if p.config.CaptureOutput != "" && p.config.CaptureOutputNoClobber {
+		if err := p.checkCaptureOutput(scripts, targets); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Both what the artifact files were and what the scripts made of them
+	// are recorded, so the scripts don't run again either way. Skipping
+	// passes the input artifact on as configured, so only runs that did
+	// the same, rather than produce another one through the result, state
+	// or keep files, are recorded.
+	if p.config.SkipIfUnchanged {
+		key, keyErr := p.runKey(artifact, scripts, configuredVars, files)
+		if keyErr != nil {
+			return nil, false, fmt.Errorf("Error computing skip_if_unchanged key: %s", keyErr)
+		}
+		if p.ranUnchanged(key) {
+			ui.Say("Nothing changed since the last successful run, skipping shell scripts")
+			return artifact, keep, nil
+		}
+
+		defer func() {
+			if err != nil || results.failed() || result != artifact || resultKeep != p.config.KeepInputArtifact {
+				return
+			}
+
+			keys := []string{key}
+			if after, keyErr := p.runKey(artifact, scripts, configuredVars, files); keyErr == nil {
+				keys = append(keys, after)
+			}
+			for _, k := range keys {
+				if recordErr := p.recordRun(k); recordErr != nil {
+					log.Printf("Error recording successful run: %s", recordErr)
+				}
+			}
+		}()
+	}
+
+	if p.config.Confirm {
+		name := artifact.Id()
+		if name == "" {
+			name = artifact.String()
+		}
+		answer, err := ui.Ask(fmt.Sprintf("Run %d post-processing scripts against artifact %s? [y/N]", len(scripts), name))
+		if err != nil {
+			return nil, false, fmt.Errorf("Error asking for confirmation: %s", err)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+		default:
+			ui.Say("Not confirmed, skipping shell scripts")
+			return artifact, true, nil
+		}
+	}
+
+	if p.config.pauseBefore > 0 {
+		ui.Say(fmt.Sprintf("Pausing %s before running scripts", p.config.pauseBefore))
+		time.Sleep(p.config.pauseBefore)
+	}
+
+	// The lock is held until the teardown script is done
+	if p.config.LockName != "" || p.config.LockFile != "" {
+		path := p.lockPath()
+		lock, err := acquireLock(ui, path, p.config.lockTimeout)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error acquiring lock %s: %s", path, err)
+		}
+		log.Printf("Acquired lock: %s", path)
+		defer lock.Close()
+	}
+
+	lifecycleVars := make([]string, len(envVars), len(envVars)+1)
+	copy(lifecycleVars, envVars)
+	lifecycleVars = append(lifecycleVars, fmt.Sprintf("PACKER_ARTIFACT_FILE_COUNT=%d", len(files)))
+
+	// The teardown script runs once everything else is done, even when
+	// the setup script or any other script failed.
+	if p.config.TeardownScript != "" {
+		defer func() {
+			teardownVars := append(lifecycleVars, fmt.Sprintf("PACKER_SHELL_FAILED=%t", err != nil))
+			teardownErr := p.runLifecycleScript(ui, p.config.TeardownScript, teardownVars)
+			if teardownErr != nil {
+				if err == nil {
+					err = fmt.Errorf("Error running teardown script: %s", teardownErr)
+				} else {
+					ui.Error(fmt.Sprintf("Error running teardown script: %s", teardownErr))
+				}
+			}
+		}()
+	}
+
+	if p.config.SetupScript != "" {
+		if err := p.runLifecycleScript(ui, p.config.SetupScript, lifecycleVars); err != nil {
+			return nil, false, fmt.Errorf("Error running setup script: %s", err)
+		}
+	}
+
+	if path, err := p.runHookScripts(ui, p.config.BeforeScripts, lifecycleVars); err != nil {
+		p.runErrorScripts(ui, lifecycleVars, scriptResult{Script: path, Err: err})
+		return nil, false, fmt.Errorf("Error running before script: %s", err)
+	}
+
+	if len(p.config.Matrix) == 0 {
+		err = p.runScripts(ui, scripts, targets, envVars, "", results)
+	} else {
+		err = p.runMatrix(ui, scripts, targets, envVars, results)
+	}
+	if err != nil {
+		if failed := results.failedResults(); len(failed) > 0 {
+			p.runErrorScripts(ui, lifecycleVars, failed[0])
+		}
+
+		switch p.config.OnFailure {
+		case "cleanup_script":
+			p.runCompensationScript(ui, envVars, results.failedResults())
+		case "continue":
+			results.reportFailures(ui)
+			ui.Error(fmt.Sprintf("Continuing after failure as on_failure is 'continue': %s", err))
+			return artifact, true, nil
+		}
+		return nil, false, err
+	}
+
+	if path, err := p.runHookScripts(ui, p.config.AfterScripts, lifecycleVars); err != nil {
+		p.runErrorScripts(ui, lifecycleVars, scriptResult{Script: path, Err: err})
+		return nil, false, fmt.Errorf("Error running after script: %s", err)
+	}
+
+	// Without an artifact Packer also skips the post-processors that
+	// follow in the chain.
+	if p.config.DiscardArtifact {
+		ui.Say(fmt.Sprintf("Discarding artifact: %s", artifact.Id()))
+		return nil, false, nil
+	}
+
+	if keep, err = p.readKeepFile(keepFile, keep); err != nil {
+		return nil, false, err
+	}
+
+	resultFiles, err := p.readResultFile(resultFile)
+	if err != nil {
+		return nil, false, err
+	}
+
+	state, err := readStateFile(stateFile)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.config.ChecksumState {
+		state["checksums"] = results.allChecksums()
+	}
+
+	if len(resultFiles) > 0 && p.config.Package == "" {
+		return newFilesArtifact(resultFiles, state), keep, nil
+	}
+	if len(resultFiles) > 0 {
+		files = resultFiles
+	}
+
+	if p.config.Package != "" {
+		ui.Say(fmt.Sprintf("Packaging artifact into: %s", output))
+		if err := packageFiles(output, files, p.config.CompressionLevel); err != nil {
+			return nil, false, fmt.Errorf("Error packaging artifact: %s", err)
+		}
+		return newFilesArtifact([]string{output}, state), keep, nil
+	}
+
+	if output != "" {
+		outputFiles, err := producedFiles(output)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// The supplemented artifact takes over the input
+		if p.config.OutputArtifact == "supplement" {
+			supplemented := supplementArtifact(artifact, outputFiles)
+			supplemented.state = state
+			return supplemented, true, nil
+		}
+		return newFilesArtifact(outputFiles, state), keep, nil
+	}
+
+	// The wrapper takes over the input
+	if len(state) > 0 {
+		return wrapArtifact(artifact, state), true, nil
+	}
+
+	return artifact, keep, nil
+}
+
+// writeInlineScript writes the rendered commands to a new temporary
+// script, returning its path. The path is returned even on error once the
+// file exists, so it can be cleaned up.
+func (p *PostProcessor) writeInlineScript(commands []string, ctx *interpolate.Context) (string, error) {
+	// Windows shells pick the interpreter by extension rather than
+	// the shebang.
+	ext := p.inlineExtension()
+	tf, err := ioutil.TempFile(p.config.TempDir, "packer-shell*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("Error preparing shell script: %s", err)
+	}
+	defer tf.Close()
+
+	if err := tf.Chmod(p.scriptMode()); err != nil {
+		return tf.Name(), fmt.Errorf("Error preparing shell script: %s", err)
+	}
+
+	// Write our contents to it
+	writer := bufio.NewWriter(tf)
+	if ext == "" && len(p.config.Interpreter) == 0 {
+		writer.WriteString(fmt.Sprintf("#!%s\n", p.config.InlineShebang))
+	}
+	for i, command := range commands {
+		command, err := interpolate.Render(command, ctx)
+		if err != nil {
+			return tf.Name(), fmt.Errorf("Error processing inline command %d: %s", i+1, err)
+		}
+		if _, err := writer.WriteString(command + "\n"); err != nil {
+			return tf.Name(), fmt.Errorf("Error preparing shell script: %s", err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return tf.Name(), fmt.Errorf("Error preparing shell script: %s", err)
+	}
+	return tf.Name(), tf.Close()
+}
+
+// runMatrix runs the scripts once per matrix entry, in the order declared.
+// A failing entry doesn't stop the remaining ones; all the errors are
+// reported together at the end.
+func (p *PostProcessor) runMatrix(ui packer.Ui, scripts []ScriptConfig, files []string, envVars []string, results *runResults) error {
+	var errs *packer.MultiError
+	for _, entry := range p.config.Matrix {
+		ui.Say(fmt.Sprintf("Running matrix entry: %s", entry.Name))
+
+		matrixVars := make([]string, 0, len(envVars)+len(entry.Vars)+1)
+		matrixVars = append(matrixVars, envVars...)
+		matrixVars = append(matrixVars, fmt.Sprintf("PACKER_SHELL_MATRIX_NAME=%s", entry.Name))
+		matrixVars = append(matrixVars, entry.Vars...)
+
+		if err := p.runScripts(ui, scripts, files, matrixVars, entry.Name, results); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Matrix entry '%s': %s", entry.Name, err))
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// seen tells whether the artifact id was processed successfully before.
+// Artifacts without an id are never seen.
+func (p *PostProcessor) seen(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	p.seenIdsLock.Lock()
+	defer p.seenIdsLock.Unlock()
+	return p.seenIds[id]
+}
+
+// markSeen records the artifact id as processed, for dedup_by_id.
+func (p *PostProcessor) markSeen(id string) {
+	if id == "" {
+		return
+	}
+
+	p.seenIdsLock.Lock()
+	defer p.seenIdsLock.Unlock()
+
+	if p.seenIds == nil {
+		p.seenIds = make(map[string]bool)
+	}
+	p.seenIds[id] = true
+}
+
+// artifactFiles returns the paths the scripts run against, according to
+// artifact_source.
+func (p *PostProcessor) artifactFiles(artifact packer.Artifact) ([]string, error) {
+	if p.config.ArtifactSource == "files" {
+		return artifact.Files(), nil
+	}
+
+	key := strings.TrimPrefix(p.config.ArtifactSource, "state:")
+	var files []string
+	switch v := artifact.State(key).(type) {
+	case string:
+		if v != "" {
+			files = []string{v}
+		}
+	case []string:
+		files = v
+	case []interface{}:
+		files = make([]string, 0, len(v))
+		for _, raw := range v {
+			path, ok := raw.(string)
+			if !ok || path == "" {
+				return nil, fmt.Errorf("Artifact state '%s' contains a non-path value: %#v", key, raw)
+			}
+			files = append(files, path)
+		}
+	case nil:
+		return nil, fmt.Errorf("Artifact has no state '%s'", key)
+	default:
+		return nil, fmt.Errorf("Artifact state '%s' is not a path or list of paths: %#v", key, v)
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Artifact state '%s' contains no paths", key)
+	}
+
+	// Unlike the artifact's files, nothing says the state is up to date
+	for _, path := range files {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("Bad path in artifact state '%s': %s", key, err)
+		}
+	}
+
+	return files, nil
+}
+
+// isURL tells whether a script is an http:// or https:// URL rather than
+// a local path.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// fetchScript returns the path of a local copy of a remote script,
+// verified against script_checksums, and whether that copy is a temporary
+// file to clean up. With script_cache_dir a cached copy is reused when
+// there is one that still matches its checksum.
+func (p *PostProcessor) fetchScript(ui packer.Ui, url string) (string, bool, error) {
+	if p.config.ScriptCacheDir == "" {
+		path, err := p.downloadScript(ui, url, p.config.TempDir)
+		if err == nil {
+			err = p.verifyScript(url, path)
+		}
+		return path, true, err
+	}
+
+	sum := sha256.Sum256([]byte(url))
+	cached := filepath.Join(p.config.ScriptCacheDir, hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(cached); err == nil {
+		if err := p.verifyScript(url, cached); err == nil {
+			ui.Message(fmt.Sprintf("Using cached script: %s", url))
+			return cached, false, nil
+		}
+		log.Printf("Cached copy of %s doesn't match its checksum, downloading it again", url)
+	}
+
+	if err := os.MkdirAll(p.config.ScriptCacheDir, 0755); err != nil {
+		return "", false, err
+	}
+
+	// Downloading next to the cached copy lets it be replaced atomically,
+	// so concurrent builds never run a partial script.
+	path, err := p.downloadScript(ui, url, p.config.ScriptCacheDir)
+	if err == nil {
+		err = p.verifyScript(url, path)
+	}
+	if err != nil {
+		return path, true, err
+	}
+	if err := os.Rename(path, cached); err != nil {
+		return path, true, err
+	}
+	return cached, false, nil
+}
+
+// verifyScript checks the local copy of a remote script against the
+// checksum given for its URL in script_checksums, if any.
+func (p *PostProcessor) verifyScript(url string, path string) error {
+	pin, ok := p.config.ScriptChecksums[url]
+	if !ok {
+		return nil
+	}
+
+	t, want, err := parseScriptChecksum(pin)
+	if err != nil {
+		return err
+	}
+	got, err := fileChecksum(path, checksumTypes[t]())
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, want) {
+		return fmt.Errorf("%s checksum mismatch: expected %s, got %s", t, want, got)
+	}
+	return nil
+}
+
+// parseScriptChecksum splits an entry of script_checksums into the
+// checksum type and the checksum, which is sha256 unless given.
+func parseScriptChecksum(pin string) (string, string, error) {
+	t, sum := "sha256", pin
+	if i := strings.Index(pin, ":"); i >= 0 {
+		t, sum = pin[:i], pin[i+1:]
+	}
+	if _, ok := checksumTypes[t]; !ok {
+		return "", "", fmt.Errorf("unsupported checksum type: %s", t)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || sum == "" {
+		return "", "", fmt.Errorf("invalid checksum: %s", sum)
+	}
+	return t, sum, nil
+}
+
+// downloadScript fetches a remote script to a new executable temporary
+// file in dir, returning its path. The path is returned even on error once
+// the file exists, so it can be cleaned up.
+func (p *PostProcessor) downloadScript(ui packer.Ui, url string, dir string) (string, error) {
+	ui.Message(fmt.Sprintf("Downloading script: %s", url))
+
+	client := &http.Client{Timeout: scriptDownloadTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	tf, err := ioutil.TempFile(dir, "packer-shell-remote")
+	if err != nil {
+		return "", err
+	}
+	defer tf.Close()
+
+	if _, err := io.Copy(tf, resp.Body); err != nil {
+		return tf.Name(), err
+	}
+	if err := tf.Chmod(p.scriptMode()); err != nil {
+		return tf.Name(), err
+	}
+	return tf.Name(), tf.Close()
+}
+
+// discoverScripts lists the scripts in scripts_dir, sorted by name.
+func (p *PostProcessor) discoverScripts() ([]ScriptConfig, error) {
+	entries, err := ioutil.ReadDir(p.config.ScriptsDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading scripts_dir: %s", err)
+	}
+
+	// ReadDir already sorts the entries by name
+	var scripts []ScriptConfig
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		if p.config.ScriptsDirPattern != "" {
+			if ok, _ := filepath.Match(p.config.ScriptsDirPattern, fi.Name()); !ok {
+				continue
+			}
+		} else if fi.Mode()&0111 == 0 {
+			log.Printf("Skipping non-executable file in scripts_dir: %s", fi.Name())
+			continue
+		}
+
+		scripts = append(scripts, ScriptConfig{
+			Path: filepath.Join(p.config.ScriptsDir, fi.Name()),
+		})
+	}
+
+	return scripts, nil
+}
+
+// builderIdAllowed reports whether artifacts from the given builder should
+// be processed according to only_builder_ids and except_builder_ids.
+func (p *PostProcessor) builderIdAllowed(id string) bool {
+	if len(p.config.OnlyBuilderIds) > 0 {
+		return hasAnyPrefix(id, p.config.OnlyBuilderIds)
+	}
+
+	return !hasAnyPrefix(id, p.config.ExceptBuilderIds)
+}
+
+// buildAllowed tells whether the current build is one the scripts run
+// for, going by its builder type and build name.
+func (p *PostProcessor) buildAllowed() bool {
+	return matchesFilter(p.config.PackerBuilderType, p.config.OnlyBuilderTypes, p.config.ExceptBuilderTypes) &&
+		matchesFilter(p.config.PackerBuildName, p.config.OnlyBuildNames, p.config.ExceptBuildNames)
+}
+
+// matchesFilter tells whether s matches one of the only globs, when there
+// are any, or none of the except ones.
+func matchesFilter(s string, only []string, except []string) bool {
+	if len(only) > 0 {
+		return matchesAny(s, only)
+	}
+	return !matchesAny(s, except)
+}
+
+func matchesAny(s string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// createScratchDir creates the scratch directory and tries to mount a
+// tmpfs on it, reporting whether the mount succeeded.
+func (p *PostProcessor) createScratchDir(ui packer.Ui) (string, bool, error) {
+	dir, err := ioutil.TempDir(p.config.TmpDir, "packer-shell-scratch")
+	if err != nil {
+		return "", false, fmt.Errorf("Error creating scratch directory: %s", err)
+	}
+
+	if err := mountTmpfs(dir, p.config.ScratchSize); err != nil {
+		ui.Error(fmt.Sprintf(
+			"Warning: could not mount tmpfs for scratch directory, using a regular directory: %s", err))
+		return dir, false, nil
+	}
+
+	log.Printf("Mounted tmpfs scratch directory: %s", dir)
+	return dir, true, nil
+}
+
+// checkFreeSpace fails if the filesystem the output is written to has less
+// than min_free_space available. Where free space can't be checked, a
+// warning is shown instead.
+func (p *PostProcessor) checkFreeSpace(ui packer.Ui, output string) error {
+	dir := "."
+	if output != "" {
+		dir = filepath.Dir(output)
+	}
+
+	free, err := freeSpace(dir)
+	if err == errFreeSpaceUnsupported {
+		ui.Error(fmt.Sprintf("Warning: not checking min_free_space: %s", err))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error checking free disk space of %s: %s", dir, err)
+	}
+
+	log.Printf("Free disk space of %s: %d bytes", dir, free)
+	if free < p.config.minFreeSpace {
+		return fmt.Errorf("Not enough free disk space in %s: %d bytes available, min_free_space is %s",
+			dir, free, p.config.MinFreeSpace)
+	}
+	return nil
+}
+
+// parseSize parses a size in bytes with an optional binary K, M, G or T
+// suffix.
+func parseSize(size string) (uint64, error) {
+	m := sizeRe.FindStringSubmatch(size)
+	if m == nil {
+		return 0, fmt.Errorf("'%s' is not a size such as 512M or 10G", size)
+	}
+
+	n, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	shift := map[string]uint{"": 0, "k": 10, "m": 20, "g": 30, "t": 40}[strings.ToLower(m[2])]
+	if n > ^uint64(0)>>shift {
+		return 0, fmt.Errorf("'%s' is too large", size)
+	}
+	return n << shift, nil
+}
+
+// checkPrecondition runs the precondition command and reports whether it
+// succeeded. The precondition vars are applied over the given base set.
+func (p *PostProcessor) checkPrecondition(ui packer.Ui, envVars []string) (bool, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	ui.Say(fmt.Sprintf("Checking precondition: %s", p.config.Precondition))
+	cmd := p.shellCommand(context.Background(), p.config.Precondition)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Stdin = p.stdin()
+	cmd.Env = append(os.Environ(), envVars...)
+	cmd.Env = append(cmd.Env, p.config.PreconditionVars...)
+	err := cmd.Run()
+
+	log.Printf("precondition stdout: %s", strings.TrimSpace(stdout.String()))
+	log.Printf("precondition stderr: %s", strings.TrimSpace(stderr.String()))
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return false, fmt.Errorf("Error executing precondition: %s", err)
+	}
+
+	return true, nil
+}
+
+// runLifecycleScript runs the setup or teardown script, which gets no
+// artifact file argument. Like the other scripts it's stopped, with
+// whatever it started, on timeout, total_timeout or interrupt.
+func (p *PostProcessor) runLifecycleScript(ui packer.Ui, path string, envVars []string) error {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	ui.Say(fmt.Sprintf("Running shell script: %s", path))
+
+	ctx := context.Background()
+	if !p.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, p.deadline)
+		defer cancel()
+	}
+	if p.config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.timeout)
+		defer cancel()
+	}
+
+	cmd := p.shellCommand(ctx, p.scriptCommand(p.scriptPath(path)))
+	cmd.Dir = p.config.WorkingDirectory
+	cmd.Stdin = p.stdin()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), envVars...)
+	setProcessGroup(cmd)
+
+	if isInterrupted() {
+		return fmt.Errorf("Interrupted, not running script %s", path)
+	}
+
+	start := time.Now()
+	err := cmd.Start()
+	if err == nil {
+		stop := p.stopOnCancel(ctx, cmd)
+		err = cmd.Wait()
+		stop()
+	}
+
+	log.Printf("stdout: %s", strings.TrimSpace(stdout.String()))
+	log.Printf("stderr: %s", strings.TrimSpace(stderr.String()))
+
+	if err != nil && isInterrupted() {
+		return fmt.Errorf("Script %s stopped after %s, interrupted",
+			path, time.Since(start).Round(time.Millisecond))
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if !p.deadline.IsZero() && !time.Now().Before(p.deadline) {
+			return fmt.Errorf("Script %s killed after %s, total_timeout of %s exceeded",
+				path, elapsed, p.config.totalTimeout)
+		}
+		return fmt.Errorf("Script %s killed after %s, timeout of %s exceeded",
+			path, elapsed, p.config.timeout)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return &ScriptError{
+			Path:     path,
+			ExitCode: exitErr.ExitCode(),
+			Valid:    []int{0},
+			Stdout:   strings.TrimSpace(stdout.String()),
+			Stderr:   strings.TrimSpace(stderr.String()),
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// stopOnCancel stops the process group of the started command once ctx
+// is done or the build is interrupted. The returned function must be
+// called once the command was waited for.
+func (p *PostProcessor) stopOnCancel(ctx context.Context, cmd *exec.Cmd) func() {
+	waited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-interrupted:
+		case <-waited:
+			return
+		}
+		p.stopProcessGroup(cmd.Process.Pid, waited)
+	}()
+	return func() { close(waited) }
+}
+
+// runHookScripts runs the scripts of before_scripts or after_scripts in
+// order, stopping at the first that fails and returning its path.
+func (p *PostProcessor) runHookScripts(ui packer.Ui, paths []string, envVars []string) (string, error) {
+	for _, path := range paths {
+		if err := p.runLifecycleScript(ui, path, envVars); err != nil {
+			return path, err
+		}
+	}
+	return "", nil
+}
+
+// runErrorScripts runs every one of error_scripts after a script failed,
+// telling them which one through PACKER_SHELL_FAILED_SCRIPT,
+// PACKER_SHELL_FAILED_FILE and PACKER_SHELL_FAILED_EXIT_CODE, which is
+// empty when the script didn't exit with a code. Their failures are only
+// reported.
+func (p *PostProcessor) runErrorScripts(ui packer.Ui, envVars []string, failed scriptResult) {
+	if len(p.config.ErrorScripts) == 0 {
+		return
+	}
+
+	code := ""
+	if exitErr, ok := failed.Err.(*ScriptError); ok {
+		code = strconv.Itoa(exitErr.ExitCode)
+	}
+
+	vars := make([]string, len(envVars), len(envVars)+3)
+	copy(vars, envVars)
+	vars = append(vars,
+		fmt.Sprintf("PACKER_SHELL_FAILED_SCRIPT=%s", failed.Script),
+		fmt.Sprintf("PACKER_SHELL_FAILED_FILE=%s", failed.File),
+		fmt.Sprintf("PACKER_SHELL_FAILED_EXIT_CODE=%s", code))
+
+	for _, path := range p.config.ErrorScripts {
+		if err := p.runLifecycleScript(ui, path, vars); err != nil {
+			ui.Error(fmt.Sprintf("Error running error script: %s", err))
+		}
+	}
+}
+
+// runCompensationScript runs compensation_script after a script failed,
+// telling it which one through PACKER_SHELL_FAILED_SCRIPT and
+// PACKER_SHELL_FAILED_FILE. Its failure is only reported.
+func (p *PostProcessor) runCompensationScript(ui packer.Ui, envVars []string, results []scriptResult) {
+	vars := make([]string, len(envVars), len(envVars)+2)
+	copy(vars, envVars)
+	for _, r := range results {
+		if r.Err != nil {
+			vars = append(vars,
+				fmt.Sprintf("PACKER_SHELL_FAILED_SCRIPT=%s", r.Script),
+				fmt.Sprintf("PACKER_SHELL_FAILED_FILE=%s", r.File))
+			break
+		}
+	}
+
+	if err := p.runLifecycleScript(ui, p.config.CompensationScript, vars); err != nil {
+		ui.Error(fmt.Sprintf("Error running compensation script: %s", err))
+	}
+}
+
+// evalDynamicVars runs the commands of dynamic_environment_vars with the
+// given environment and returns the variables set to their output.
+func (p *PostProcessor) evalDynamicVars(envVars []string) ([]string, error) {
+	vars := make([]string, 0, len(p.config.DynamicVars))
+	for _, kv := range p.config.DynamicVars {
+		vs := strings.SplitN(kv, "=", 2)
+
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+
+		log.Printf("Evaluating dynamic environment variable %s", vs[0])
+		cmd := p.shellCommand(context.Background(), vs[1])
+		cmd.Stdin = p.stdin()
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Env = append(os.Environ(), envVars...)
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("Error evaluating dynamic environment variable %s: %s: %s",
+				vs[0], err, strings.TrimSpace(stderr.String()))
+		}
+
+		vars = append(vars, fmt.Sprintf("%s=%s", vs[0], strings.TrimSpace(stdout.String())))
+	}
+
+	return vars, nil
+}
+
+// runScripts executes every script against every artifact file with the
+// given environment variables, stopping at the first failure unless the
+// files are processed in parallel. The outcome of every combination,
+// including those skipped after a failure, is recorded in results.
+func (p *PostProcessor) runScripts(ui packer.Ui, scripts []ScriptConfig, files []string, envVars []string, matrix string, results *runResults) error {
+	if p.config.Parallel {
+		return p.runScriptsParallel(ui, scripts, files, envVars, matrix, results)
+	}
+
+	var failure error
+	for _, art := range files {
+		failure = p.runFile(ui, scripts, art, envVars, matrix, results, failure)
+	}
+
+	return failure
+}
+
+// errFailedFast marks the files fail_fast skipped.
+var errFailedFast = errors.New("skipped after an earlier failure")
+
+// runScriptsParallel processes the artifact files concurrently, up to
+// parallel_jobs at a time. Failures are collected in the order of the
+// files rather than the order they happened in. With
+// output_order "grouped" the UI output of each file is held back and
+// flushed in the order of the files once they and all files before them
+// are done, so it isn't interleaved.
+func (p *PostProcessor) runScriptsParallel(ui packer.Ui, scripts []ScriptConfig, files []string, envVars []string, matrix string, results *runResults) error {
+	// Each file's results are handed on to results once it's done, which
+	// decides what to keep of them.
+	fileResults := make([]runResults, len(files))
+	for i := range fileResults {
+		fileResults[i].keepAll = true
+	}
+	fileUis := make([]*bufferedUi, len(files))
+	done := make([]chan error, len(files))
+
+	for i := range files {
+		if p.config.OutputOrder == "grouped" {
+			fileUis[i] = &bufferedUi{ui: ui}
+		}
+		done[i] = make(chan error, 1)
+	}
+
+	// A pool of parallel_jobs workers processes the files in order
+	work := make(chan int)
+	go func() {
+		for i := range files {
+			work <- i
+		}
+		close(work)
+	}()
+
+	// With fail_fast, files that weren't started when one failed are only
+	// recorded as skipped.
+	var failed int32
+	for n := 0; n < p.config.ParallelJobs; n++ {
+		go func() {
+			for i := range work {
+				var fileUi packer.Ui = ui
+				if fileUis[i] != nil {
+					fileUi = fileUis[i]
+				}
+
+				var failure error
+				if atomic.LoadInt32(&failed) != 0 {
+					failure = errFailedFast
+				}
+
+				err := p.runFile(fileUi, scripts, files[i], envVars, matrix, &fileResults[i], failure)
+				if err != nil && p.config.FailFast {
+					atomic.StoreInt32(&failed, 1)
+				}
+				done[i] <- err
+			}
+		}()
+	}
+
+	var errs *packer.MultiError
+	for i := range files {
+		if err := <-done[i]; err != nil && err != errFailedFast {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+		if fileUis[i] != nil {
+			fileUis[i].flush(ui)
+		}
+
+		for _, result := range fileResults[i].all() {
+			results.add(result)
+		}
+		fileResults[i].results = nil
+		for file, sums := range fileResults[i].checksums {
+			results.addChecksums(file, sums)
+		}
+	}
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// runFile runs every script against a single artifact file. If failure is
+// set, an earlier file failed and the scripts are only recorded as
+// skipped. It returns the first error, either the given one or one of the
+// scripts.
+func (p *PostProcessor) runFile(ui packer.Ui, scripts []ScriptConfig, art string, envVars []string, matrix string, results *runResults, failure error) error {
+	var checksum string
+	if p.config.ReadOnly && failure == nil {
+		var err error
+		checksum, err = p.readOnlyChecksum(art)
+		if err != nil {
+			failure = fmt.Errorf("Error checksumming artifact file %s: %s", art, err)
+		}
+	}
+
+	fileVars := envVars
+	if p.config.ComputeChecksum && failure == nil {
+		sums, err := p.artifactChecksums(art)
+		if err != nil {
+			failure = fmt.Errorf("Error computing checksum of %s: %s", art, err)
+		} else {
+			results.addChecksums(art, sums)
+		}
+
+		fileVars = make([]string, len(envVars), len(envVars)+len(sums))
+		copy(fileVars, envVars)
+		for _, t := range p.config.ChecksumTypes {
+			fileVars = append(fileVars, fmt.Sprintf("PACKER_ARTIFACT_%s=%s", strings.ToUpper(t), sums[t]))
+		}
+	}
+
+	for i, script := range scripts {
+		result := scriptResult{
+			Script: script.Path,
+			File:   art,
+			Matrix: matrix,
+		}
+
+		if failure != nil {
+			result.Skipped = true
+			results.add(result)
+			continue
+		}
+
+		if i > 0 && p.config.pauseBetween > 0 {
+			ui.Message(fmt.Sprintf("Pausing %s before the next script", p.config.pauseBetween))
+			time.Sleep(p.config.pauseBetween)
+		}
+
+		retries := p.config.MaxRetries
+		if script.Retries != nil {
+			retries = *script.Retries
+		}
+
+		start := time.Now()
+		stepVars := fileVars
+		if len(script.Vars) > 0 {
+			stepVars = append(fileVars[:len(fileVars):len(fileVars)], script.Vars...)
+		}
+		attemptVars := stepVars
+		result.Start = start
+		if p.config.ExecutionLog != "" {
+			result.Argv = p.commandArgv(script, art, attemptVars)
+		}
+		delay := p.config.retryDelay
+		for attempt := 0; ; attempt++ {
+			result.Stdout, result.Stderr, result.Err = p.runScript(ui, script, art, attemptVars)
+			if result.Err == nil || attempt >= retries || !p.retryable(result.Err) || isInterrupted() {
+				break
+			}
+
+			ui.Message(fmt.Sprintf("Script failed, retrying (%d/%d) in %s: %s", attempt+1, retries, delay, result.Err))
+			time.Sleep(delay)
+			delay = p.nextRetryDelay(delay)
+
+			if p.config.RefreshOnRetry && len(p.config.DynamicVars) > 0 {
+				// Fresh values are appended, overriding the old ones
+				dynamicVars, err := p.evalDynamicVars(fileVars)
+				if err != nil {
+					result.Err = err
+					break
+				}
+				attemptVars = append(stepVars[:len(stepVars):len(stepVars)], dynamicVars...)
+			}
+		}
+		result.Duration = time.Since(start)
+
+		if result.Err == nil && checksum != "" {
+			after, err := p.readOnlyChecksum(art)
+			if err != nil {
+				result.Err = fmt.Errorf("Error checksumming artifact file %s: %s", art, err)
+			} else if after != checksum {
+				result.Err = fmt.Errorf("Script %s modified artifact file %s, but read_only is set", script.Path, art)
+			}
+		}
+
+		if result.Err == nil {
+			ui.Message(fmt.Sprintf("Script %s succeeded with %s in %s", script.Path, art, result.Duration))
+		}
+
+		// With nothing reporting the output, holding on to it for every
+		// run would only make memory grow with the number of files.
+		if !p.keepsOutput() {
+			result.Stdout, result.Stderr = "", ""
+		}
+
+		results.add(result)
+		failure = result.Err
+	}
+
+	return failure
+}
+
+// keepsOutput tells whether anything needs the output of the script runs
+// once they're done.
+func (p *PostProcessor) keepsOutput() bool {
+	return p.config.CaptureOutput != "" ||
+		p.config.JUnitReport != "" ||
+		p.config.MarkdownReport != "" ||
+		p.config.ExecutionLog != ""
+}
+
+// joinFiles quotes each of the files for the shell and joins them with
+// spaces, so that a path containing spaces stays a single argument.
+func (p *PostProcessor) joinFiles(files []string) string {
+	quoted := make([]string, len(files))
+	for i, file := range files {
+		quoted[i] = p.quote(file)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// batchFiles groups the files greedily, in order, into batches whose
+// combined size doesn't exceed max. A file larger than max on its own gets
+// a batch of its own.
+func batchFiles(ui packer.Ui, files []string, max int64) ([][]string, error) {
+	var batches [][]string
+	var batch []string
+	var size int64
+
+	flush := func() {
+		if len(batch) > 0 {
+			batches = append(batches, batch)
+			batch = nil
+			size = 0
+		}
+	}
+
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading size of artifact file %s: %s", file, err)
+		}
+
+		if fi.Size() > max {
+			ui.Message(fmt.Sprintf(
+				"Artifact file %s is larger than batch_max_bytes (%d > %d), processing it alone",
+				file, fi.Size(), max))
+			flush()
+			batch = []string{file}
+			flush()
+			continue
+		}
+
+		if size+fi.Size() > max {
+			flush()
+		}
+		batch = append(batch, file)
+		size += fi.Size()
+	}
+	flush()
+
+	log.Printf("Batched %d artifact files into %d batches", len(files), len(batches))
+	return batches, nil
+}
+
+// listDir shows the files in the directory and their sizes. An empty dir
+// means the current directory.
+func listDir(ui packer.Ui, dir string) {
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error listing %s: %s", dir, err))
+		return
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+
+	ui.Message(fmt.Sprintf("Files in %s:", abs))
+	for _, fi := range entries {
+		if fi.IsDir() {
+			ui.Message(fmt.Sprintf("  %s/", fi.Name()))
+		} else {
+			ui.Message(fmt.Sprintf("  %s (%d bytes)", fi.Name(), fi.Size()))
+		}
+	}
+}
+
+// stdin returns what spawned commands read as stdin, per stdin_behavior.
+func (p *PostProcessor) stdin() io.Reader {
+	switch p.config.StdinBehavior {
+	case "inherit":
+		return os.Stdin
+	case "null":
+		// A nil stdin reads from the null device
+		return nil
+	default:
+		// An empty reader makes exec hand the command a pipe that is
+		// closed as soon as it starts, so reads get EOF immediately.
+		return strings.NewReader("")
+	}
+}
+
+// reportResourceUsage tells the UI how much CPU time and memory the
+// exited script used. Peak memory isn't available on every platform.
+func reportResourceUsage(ui packer.Ui, path string, state *os.ProcessState) {
+	usage := fmt.Sprintf("Resource usage of %s: user %s, system %s",
+		filepath.Base(path), state.UserTime(), state.SystemTime())
+	if kb, ok := peakMemoryKB(state); ok {
+		usage += fmt.Sprintf(", peak memory %d KB", kb)
+	}
+	ui.Message(usage)
+}
+
+// validExitCode tells whether a script exiting with code succeeded.
+func validExitCode(valids []int, code int) bool {
+	for _, valid := range valids {
+		if code == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable tells whether a script that failed with err is retried. With
+// retryable_exit_codes, only scripts exiting with one of them are.
+func (p *PostProcessor) retryable(err error) bool {
+	if len(p.config.RetryableExitCodes) == 0 {
+		return true
+	}
+
+	exitErr, ok := err.(*ScriptError)
+	if !ok {
+		return false
+	}
+	for _, code := range p.config.RetryableExitCodes {
+		if exitErr.ExitCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// stopProcessGroup stops the script process group led by pid, sending
+// SIGTERM first and killing it if it hasn't exited within kill_timeout.
+func (p *PostProcessor) stopProcessGroup(pid int, waited <-chan struct{}) {
+	if err := terminateProcessGroup(pid); err != nil {
+		log.Printf("Error terminating script processes: %s", err)
+	}
+
+	select {
+	case <-waited:
+	case <-time.After(p.config.killTimeout):
+		if err := killProcessGroup(pid); err != nil {
+			log.Printf("Error killing script processes: %s", err)
+		}
+	}
+}
+
+// nextRetryDelay returns the delay before the retry after one that waited
+// delay, grown by retry_backoff up to retry_max_delay.
+func (p *PostProcessor) nextRetryDelay(delay time.Duration) time.Duration {
+	next := time.Duration(float64(delay) * p.config.RetryBackoff)
+	if p.config.retryMax > 0 && next > p.config.retryMax {
+		next = p.config.retryMax
+	}
+	return next
+}
+
+// changesDirectory tells whether any script runs in a working_directory
+// rather than Packer's current directory.
+func (p *PostProcessor) changesDirectory() bool {
+	if p.config.WorkingDirectory != "" {
+		return true
+	}
+	for _, script := range p.config.scripts {
+		if script.WorkingDirectory != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptPath returns the path a script is run from, which is absolute
+// when the scripts run in working_directory so relative paths still work.
+func (p *PostProcessor) scriptPath(path string) string {
+	if !p.changesDirectory() {
+		return path
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		log.Printf("Error making script path absolute: %s", err)
+		return path
+	}
+	return abs
+}
+
+// executeCommand renders execute_command for running the script against
+// the artifact file with the given environment variables.
+func (p *PostProcessor) executeCommand(path string, envVars []string, art string) (string, error) {
+	// The variables are quoted here, where they become part of a shell
+	// command, rather than in the environment. env_var_format leaves the
+	// quoting to the user. The secret_vars are left out, as the command
+	// line is there for anyone to read; the scripts still get them.
+	var id string
+	vars := make([]string, 0, len(envVars))
+	plain, _ := p.splitSecretVars(envVars)
+	for _, kv := range plain {
+		vs := strings.SplitN(kv, "=", 2)
+		if p.config.EnvVarFormat != "" {
+			vars = append(vars, fmt.Sprintf(p.config.EnvVarFormat, vs[0], vs[1]))
+		} else {
+			vars = append(vars, fmt.Sprintf("%s=%s", vs[0], p.quote(vs[1])))
+		}
+		if vs[0] == "PACKER_ARTIFACT_ID" {
+			id = vs[1]
+		}
+	}
+
+	args := make([]string, len(p.config.ScriptArgs))
+	for i, arg := range p.config.ScriptArgs {
+		args[i] = p.quote(arg)
+	}
+
+	ctx := p.config.ctx
+	ctx.Data = &executeCommandData{
+		Path:           path,
+		Script:         path,
+		QuotedPath:     p.quote(path),
+		Vars:           strings.Join(vars, " "),
+		Artifact:       art,
+		ArtifactFile:   art,
+		QuotedArtifact: p.quote(art),
+		ArtifactId:     id,
+		Args:           strings.Join(args, " "),
+	}
+	return interpolate.Render(p.config.ExecuteCommand, &ctx)
+}
+
+// processTitle renders process_title_template for running the script
+// against the artifact file.
+func (p *PostProcessor) processTitle(script string, art string) (string, error) {
+	ctx := p.config.ctx
+	ctx.Data = &processTitleData{
+		Script:      filepath.Base(script),
+		Artifact:    art,
+		BuildName:   p.config.PackerBuildName,
+		BuilderType: p.config.PackerBuilderType,
+	}
+	return interpolate.Render(p.config.ProcessTitleTemplate, &ctx)
+}
+
+// traceCommand makes cmd run under the tracer, tracing the system calls
+// of the shell and everything it starts.
+func (p *PostProcessor) traceCommand(ui packer.Ui, cmd *exec.Cmd, script string) error {
+	path, err := exec.LookPath(tracer)
+	if err != nil {
+		return fmt.Errorf("Error finding %s for trace_syscalls: %s", tracer, err)
+	}
+
+	if err := os.MkdirAll(p.config.TraceOutput, 0755); err != nil {
+		return fmt.Errorf("Error creating trace_output directory: %s", err)
+	}
+
+	out := filepath.Join(p.config.TraceOutput, fmt.Sprintf("%s.%d.trace",
+		filepath.Base(script), atomic.AddInt64(&p.traceCount, 1)))
+	ui.Message(fmt.Sprintf("Tracing system calls of %s with %s", filepath.Base(script), tracer))
+	log.Printf("Writing trace to %s", out)
+
+	// The tracer runs the shell by path, replacing any custom argv[0]
+	args := append([]string{tracer}, tracerArgs(out)...)
+	cmd.Args = append(append(args, cmd.Path), cmd.Args[1:]...)
+	cmd.Path = path
+	return nil
+}
+
+// checkWritableDir makes sure that dir is an existing directory files can
+// be created in.
+func checkWritableDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	f, err := ioutil.TempFile(dir, "packer-shell-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// openExtraFile opens one of extra_files for reading and writing when
+// permitted, and for reading only otherwise.
+func openExtraFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsPermission(err) {
+		f, err = os.Open(path)
+	}
+	return f, err
+}
+
+// lookupGroupId resolves a group name or numeric GID to a GID.
+func lookupGroupId(group string) (uint32, error) {
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(gid), nil
+}
+
+// normalizeExtension makes ".ISO", "iso" and ".iso" all the same.
+func normalizeExtension(ext string) string {
+	return strings.ToLower(strings.TrimPrefix(ext, "."))
+}
+
+// readOnlyChecksum returns the fingerprint read_only compares to detect a
+// modified artifact file, according to change_detection. Directories
+// aren't checked, so their fingerprint is empty.
+func (p *PostProcessor) readOnlyChecksum(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		log.Printf("Not checking artifact directory for modifications: %s", path)
+		return "", nil
+	}
+
+	return changeDetectors[p.config.ChangeDetection].Fingerprint(path, fi)
+}
+
+// runScript executes a single script against a single artifact file,
+// returning its trimmed output.
+func (p *PostProcessor) runScript(ui packer.Ui, script ScriptConfig, art string, envVars []string) (string, string, error) {
+	stdoutBuf := getOutputBuffer()
+	defer putOutputBuffer(stdoutBuf)
+	stderrBuf := getOutputBuffer()
+	defer putOutputBuffer(stderrBuf)
+
+	head := p.config.OutputTruncation == "head"
+	stdout := newLimitedBuffer(stdoutBuf, p.config.MaxOutputBytes, head)
+	stderr := newLimitedBuffer(stderrBuf, p.config.MaxOutputBytes, head)
+
+	path := script.Path
+	ui.Say(fmt.Sprintf("Processing with shell script: %s", path))
+
+	if p.pidFile != nil {
+		if err := p.pidFile.Update(fmt.Sprintf("%s %s", path, art)); err != nil {
+			log.Printf("Error updating PID file: %s", err)
+		}
+	}
+
+	log.Printf("Opening %s for reading", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", fmt.Errorf("Error opening shell script: %s", err)
+	}
+	defer f.Close()
+
+	timeout := p.config.timeout
+	if t, ok := p.config.timeoutByExtension[normalizeExtension(filepath.Ext(art))]; ok {
+		timeout = t
+	}
+	if script.RawTimeout != "" {
+		timeout = script.timeout
+	}
+
+	// Waiting for a slot doesn't count towards the timeout
+	if p.slots != nil {
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+	}
+
+	ctx := context.Background()
+	if !p.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, p.deadline)
+		defer cancel()
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stdin := p.stdin()
+	if p.config.Stdin != "" {
+		stdin = strings.NewReader(p.config.Stdin)
+	} else if p.config.StdinFile != "" {
+		f, err := os.Open(p.config.StdinFile)
+		if err != nil {
+			return "", "", fmt.Errorf("Error opening stdin_file: %s", err)
+		}
+		defer f.Close()
+		stdin = f
+	}
+
+	ui.Message(fmt.Sprintf("Executing script with artifact: %s", art))
+	var cmd *exec.Cmd
+	if p.config.Remote != nil {
+		cmd, err = p.remoteCommand(ctx, ui, path, art, envVars)
+		if err != nil {
+			return "", "", err
+		}
+	} else if p.config.DockerImage != "" {
+		cmd, err = p.dockerCommand(ctx, path, art, envVars)
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		command, err := p.executeCommand(p.scriptPath(path), envVars, art)
+		if err != nil {
+			return "", "", fmt.Errorf("Error processing execute_command: %s", err)
+		}
+		log.Printf("Executing shell command: %s", command)
+		if p.config.OutputLevel == "verbose" {
+			ui.Message(fmt.Sprintf("Executing shell command: %s", command))
+		}
+		if len(p.config.ElevateCommand) > 0 {
+			cmd, stdin = p.elevatedCommand(ctx, command, envVars, stdin)
+		} else {
+			cmd = p.shellCommand(ctx, command)
+		}
+	}
+	cmd.Dir = p.config.WorkingDirectory
+	if script.WorkingDirectory != "" {
+		cmd.Dir = script.WorkingDirectory
+	}
+	cmd.Stdin = stdin
+
+	// The output is kept for the result, and shown unless quiet, when
+	// it's only logged: as it comes, or once the script is done with
+	// output_mode "buffered".
+	stdoutUi := newUiWriter(ui.Message)
+	stderrUi := newUiWriter(ui.Error)
+	if p.config.OutputLevel == "quiet" {
+		stdoutUi = newUiWriter(func(line string) { log.Printf("%s stdout: %s", path, line) })
+		stderrUi = newUiWriter(func(line string) { log.Printf("%s stderr: %s", path, line) })
+	}
+	// A sink failing mid-run mustn't stop the output from being copied,
+	// or the script would die of SIGPIPE.
+	var sinks []*safeWriter
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if p.config.OutputMode == "stream" {
+		stdoutSink := newSafeWriter(stdoutUi)
+		stderrSink := newSafeWriter(stderrUi)
+		sinks = append(sinks, stdoutSink, stderrSink)
+		cmd.Stdout = io.MultiWriter(stdout, stdoutSink)
+		cmd.Stderr = io.MultiWriter(stderr, stderrSink)
+	}
+
+	// The whole output goes to output_file, however little is kept
+	if p.config.OutputFile != "" {
+		f, err := p.openOutputFile(path, art)
+		if err != nil {
+			return "", "", fmt.Errorf("Error opening output_file: %s", err)
+		}
+		defer f.Close()
+		fileSink := newSafeWriter(f)
+		sinks = append(sinks, fileSink)
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, fileSink)
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, fileSink)
+	}
+	cmd.Env = append(os.Environ(), envVars...)
+	if p.config.Remote != nil {
+		cmd.Env = append(cmd.Env, p.config.Remote.env()...)
+	}
+
+	// The shell's argv[0] is set separately from the path it's run from,
+	// and passed as the operand sh -c assigns to $0.
+	if p.config.ShellArgv0 != "" {
+		cmd.Args[0] = p.config.ShellArgv0
+		cmd.Args = append(cmd.Args, p.config.ShellArgv0)
+	}
+
+	// The title takes precedence over shell_argv0 for argv[0], leaving
+	// it only $0.
+	if p.config.ProcessTitleTemplate != "" && runtime.GOOS != "windows" {
+		title, err := p.processTitle(path, art)
+		if err != nil {
+			return "", "", fmt.Errorf("Error processing process_title_template: %s", err)
+		}
+		cmd.Args[0] = title
+	}
+
+	if p.config.TraceSyscalls {
+		if err := p.traceCommand(ui, cmd, path); err != nil {
+			return "", "", err
+		}
+	}
+
+	if p.config.Progress {
+		cmd.Stdout = newProgressWriter(cmd.Stdout, ui, filepath.Base(path))
+	}
+
+	if p.config.NetworkIsolation {
+		if err := isolateNetwork(cmd); err != nil {
+			return "", "", err
+		}
+	}
+
+	if len(p.config.groupIds) > 0 {
+		if err := setGroups(cmd, p.config.groupIds); err != nil {
+			return "", "", err
+		}
+	}
+
+	for i, path := range p.config.ExtraFiles {
+		f, err := openExtraFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("Error opening extra file: %s", err)
+		}
+		defer f.Close()
+
+		// ExtraFiles[i] becomes file descriptor 3+i
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PACKER_EXTRA_FD_%d=%d", i, 3+i))
+	}
+
+	var pipes *secretPipes
+	if len(p.config.SecretPipes) > 0 {
+		pipes, err = newSecretPipes(p.config.TmpDir, p.config.SecretPipes)
+		if err != nil {
+			return "", "", err
+		}
+		cmd.Env = append(cmd.Env, pipes.Env()...)
+	}
+
+	// Only stdin and stdin_file are typed into the terminal; there's
+	// nothing to close to signal the end of them.
+	var terminal *scriptTerminal
+	if p.config.Pty {
+		var input io.Reader
+		if p.config.Stdin != "" || p.config.StdinFile != "" {
+			input = cmd.Stdin
+		}
+		terminal, err = newScriptTerminal(cmd, input)
+		if err != nil {
+			return "", "", fmt.Errorf("Error opening pseudo-terminal: %s", err)
+		}
+		defer terminal.close()
+	}
+
+	// Stopping only the shell on timeout or interrupt could leave whatever
+	// it started running and holding on to the output, so Wait would never
+	// return. A script with a terminal already leads its own session.
+	if terminal == nil {
+		setProcessGroup(cmd)
+	}
+
+	if isInterrupted() {
+		return "", "", fmt.Errorf("Interrupted, not running script %s", path)
+	}
+
+	start := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		if terminal != nil {
+			terminal.start()
+		}
+
+		stop := p.stopOnCancel(ctx, cmd)
+		err = cmd.Wait()
+		stop()
+
+		if terminal != nil {
+			terminal.wait()
+		}
+	}
+	for _, sink := range sinks {
+		sink.Close()
+	}
+	if p.config.OutputMode == "buffered" {
+		stdoutUi.Write(stdout.Bytes())
+		stderrUi.Write(stderr.Bytes())
+	}
+	stdoutUi.Flush()
+	stderrUi.Flush()
+
+	if pipes != nil {
+		if err := pipes.Close(); err != nil {
+			log.Printf("Error removing secret pipes: %s", err)
+		}
+	}
+
+	if p.config.ReportResourceUsage && cmd.ProcessState != nil {
+		reportResourceUsage(ui, path, cmd.ProcessState)
+	}
+
+	if p.config.ListOutputDir {
+		listDir(ui, cmd.Dir)
+	}
+
+	stdoutString := p.redact(strings.TrimSpace(stdout.String()))
+	stderrString := p.redact(strings.TrimSpace(stderr.String()))
+
+	var code int
+	if err != nil {
+		if isInterrupted() {
+			return stdoutString, stderrString, fmt.Errorf("Script %s stopped after %s, interrupted",
+				path, time.Since(start).Round(time.Millisecond))
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			elapsed := time.Since(start).Round(time.Millisecond)
+			if !p.deadline.IsZero() && !time.Now().Before(p.deadline) {
+				return stdoutString, stderrString, fmt.Errorf("Script %s killed after %s, total_timeout of %s exceeded",
+					path, elapsed, p.config.totalTimeout)
+			}
+			return stdoutString, stderrString, fmt.Errorf("Script %s killed after %s, timeout of %s exceeded",
+				path, elapsed, timeout)
+		}
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return stdoutString, stderrString, fmt.Errorf("Error executing script %s: %s", path, err)
+		}
+		code = exitErr.ExitCode()
+	}
+
+	valid := p.config.ValidExitCodes
+	if len(script.ValidExitCodes) > 0 {
+		valid = script.ValidExitCodes
+	}
+	if !validExitCode(valid, code) {
+		return stdoutString, stderrString, &ScriptError{
+			Path:     path,
+			ExitCode: code,
+			Valid:    valid,
+			Stdout:   stdoutString,
+			Stderr:   stderrString,
+		}
+	}
+	if code != 0 {
+		log.Printf("Script exited with valid exit code %d", code)
+	}
+
+	if err := p.checkOutput(stdoutString, stderrString); err != nil {
+		return stdoutString, stderrString, fmt.Errorf("Script %s %s", path, err)
+	}
+
+	log.Printf("stdout: %s", stdoutString)
+	log.Printf("stderr: %s", stderrString)
+
+	return stdoutString, stderrString, nil
+}
+
+// decodeScript decodes an entry of scripts, which is either a plain path
+// or an object with per-script settings.
+func decodeScript(raw interface{}) (ScriptConfig, error) {
+	var script ScriptConfig
+	if path, ok := raw.(string); ok {
+		script.Path = path
+	} else if raw != nil && reflect.TypeOf(raw).Kind() == reflect.Map {
+		// Objects arrive as map[string]interface{} from JSON but as
+		// map[interface{}]interface{} when they come over RPC.
+		if err := mapstructure.WeakDecode(raw, &script); err != nil {
+			return script, fmt.Errorf("Error decoding script: %s", err)
+		}
+		if script.Script != "" {
+			if script.Path != "" {
+				return script, errors.New("Only one of path or script can be specified.")
+			}
+			script.Path = script.Script
+		}
+		if script.Path == "" && len(script.Inline) == 0 {
+			return script, errors.New("Script objects must have a path or inline")
+		}
+		if script.Path != "" && len(script.Inline) > 0 {
+			return script, fmt.Errorf("Only one of path or inline can be specified: %s", script.Path)
+		}
+		if errs := processEnvVars(script.Vars); len(errs) > 0 {
+			return script, errs[0]
+		}
+	} else {
+		return script, fmt.Errorf("Script must be a path or an object: %#v", raw)
+	}
+
+	if script.Retries != nil && *script.Retries < 0 {
+		return script, fmt.Errorf("Retries for script '%s' must not be negative", script.Path)
+	}
+
+	if script.RawTimeout != "" {
+		var err error
+		script.timeout, err = time.ParseDuration(script.RawTimeout)
+		if err != nil {
+			return script, fmt.Errorf("Failed parsing timeout for script '%s': %s", script.Path, err)
+		}
+	}
+
+	return script, nil
+}
+
+// processEnvVars checks that every variable is in 'key=value' format. The
+// values are passed to the scripts as they are.
+func processEnvVars(vars []string) []error {
+	var errs []error
+	for _, kv := range vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) != 2 || vs[0] == "" {
+			errs = append(errs,
+				fmt.Errorf("Environment variable not in format 'key=value': %s", kv))
+		}
+	}
+
+	return errs
+}
+
+// createEmptyFile creates an empty temporary file for the scripts to write
+// to, such as whether to keep the input artifact.
+func (p *PostProcessor) createEmptyFile(prefix string) (string, error) {
+	f, err := ioutil.TempFile(p.config.TmpDir, prefix)
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// readResultFile returns the files the scripts listed in the result file,
+// one per line, checking they exist. Relative paths are relative to the
+// directory the scripts ran in.
+func (p *PostProcessor) readResultFile(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading result file: %s", err)
+	}
+
+	var files []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		file := strings.TrimSpace(line)
+		if file == "" {
+			continue
+		}
+		if !filepath.IsAbs(file) && p.config.WorkingDirectory != "" {
+			file = filepath.Join(p.config.WorkingDirectory, file)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("Bad file in PACKER_RESULT_FILE: %s", err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// readStateFile returns the state the scripts wrote to the state file as
+// key=value lines, later lines overriding earlier ones.
+func readStateFile(path string) (map[string]interface{}, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading state file: %s", err)
+	}
+
+	state := make(map[string]interface{})
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		vs := strings.SplitN(line, "=", 2)
+		if len(vs) != 2 || vs[0] == "" {
+			return nil, fmt.Errorf("Scripts wrote an invalid line to PACKER_STATE_FILE, expected key=value: %q", line)
+		}
+		state[vs[0]] = vs[1]
+	}
+	return state, nil
+}
+
+// readKeepFile returns whether the scripts asked to keep the input
+// artifact through the keep file, or keep if they didn't say.
+func (p *PostProcessor) readKeepFile(path string, keep bool) (bool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("Error reading keep artifact file: %s", err)
+	}
+
+	value := strings.TrimSpace(string(contents))
+	if value == "" {
+		return keep, nil
+	}
+
+	keep, err = strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Scripts wrote an invalid value to PACKER_KEEP_ARTIFACT, expected true or false: %q", value)
+	}
+	log.Printf("Scripts asked to keep the input artifact: %t", keep)
+	return keep, nil
+}
+
+// writeEnvFile writes the variables to a new temporary file, readable
+// only by the current user, that sets them all when sourced.
+func (p *PostProcessor) writeEnvFile(envVars []string) (string, error) {
+	f, err := ioutil.TempFile(p.config.TmpDir, "packer-shell-env")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := f.Chmod(0600); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, kv := range envVars {
+		vs := strings.SplitN(kv, "=", 2)
+		fmt.Fprintf(w, "%s=%s\n", vs[0], shellQuote(vs[1]))
+	}
+
+	if err := w.Flush(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// shellQuote single quotes s for the shell, so that it is taken literally.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// writeCapturedOutput writes the output of every script run to the
+// capture_output file.
+func (p *PostProcessor) writeCapturedOutput(results []scriptResult) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if p.config.CaptureOutputNoClobber {
+		flags |= os.O_EXCL
+	}
+
+	// Runs whose paths render the same share the file, in order
+	writers := make(map[string]*bufio.Writer)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+
+		path, err := p.captureOutputPath(r.Script, r.File)
+		if err != nil {
+			return err
+		}
+
+		w, ok := writers[path]
+		if !ok {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(path, flags, 0644)
+			if err != nil {
+				return err
+			}
+			files = append(files, f)
+
+			w = bufio.NewWriter(f)
+			writers[path] = w
+		}
+
+		fmt.Fprintf(w, "==> %s %s\n", r.Script, r.File)
+		if r.Stdout != "" {
+			fmt.Fprintln(w, r.Stdout)
+		}
+		if r.Stderr != "" {
+			fmt.Fprintln(w, r.Stderr)
+		}
+	}
+
+	for _, w := range writers {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	files = nil
+	return nil
+}
+
+// outputPath renders output for the current build.
+func (p *PostProcessor) outputPath() (string, error) {
+	ctx := p.config.ctx
+	ctx.Data = &outputData{
+		BuildName:   p.config.PackerBuildName,
+		BuilderType: p.config.PackerBuilderType,
+	}
+	return interpolate.Render(p.config.OutputPath, &ctx)
+}
+
+// producedFiles returns the files the scripts produced at output, which
+// is a glob if it contains any glob characters.
+func producedFiles(output string) ([]string, error) {
+	if !strings.ContainsAny(output, "*?[") {
+		info, err := os.Stat(output)
+		if err != nil {
+			return nil, fmt.Errorf("Scripts didn't produce output %s: %s", output, err)
+		}
+		if info.IsDir() {
+			return dirFiles(output)
+		}
+		return []string{output}, nil
+	}
+
+	files, err := filepath.Glob(output)
+	if err != nil {
+		return nil, fmt.Errorf("Bad output glob %s: %s", output, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Scripts didn't produce any output matching %s", output)
+	}
+	return files, nil
+}
+
+// dirFiles returns every file in the output directory and below it.
+func dirFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error listing output directory %s: %s", dir, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Scripts didn't produce any files in %s", dir)
+	}
+	return files, nil
+}
+
+// checkCaptureOutput fails if any of the files the output of the scripts
+// run against the targets would be captured in already exists, so that
+// capture_output_no_clobber fails before anything runs.
+func (p *PostProcessor) checkCaptureOutput(scripts []ScriptConfig, targets []string) error {
+	checked := make(map[string]bool)
+	for _, script := range scripts {
+		for _, art := range targets {
+			path, err := p.captureOutputPath(script.Path, art)
+			if err != nil {
+				return fmt.Errorf("Error processing capture_output: %s", err)
+			}
+			if checked[path] {
+				continue
+			}
+			checked[path] = true
+
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("capture_output file already exists: %s", path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// captureOutputPath renders capture_output for the output of the script
+// run against the artifact file.
+func (p *PostProcessor) captureOutputPath(script string, art string) (string, error) {
+	return p.renderOutputPath(p.config.CaptureOutput, script, art)
+}
+
+// openOutputFile opens output_file for appending the output of the script
+// run against the artifact file to, starting with a header naming them.
+func (p *PostProcessor) openOutputFile(script string, art string) (*os.File, error) {
+	path, err := p.renderOutputPath(p.config.OutputFile, script, art)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "==> %s %s\n", script, art); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// renderOutputPath renders a path template such as capture_output for the
+// script run against the artifact file.
+func (p *PostProcessor) renderOutputPath(tmpl string, script string, art string) (string, error) {
+	ctx := p.config.ctx
+	ctx.Data = &captureOutputData{
+		ArtifactBase: filepath.Base(art),
+		ArtifactDir:  filepath.Dir(art),
+		Script:       filepath.Base(script),
+	}
+	return interpolate.Render(tmpl, &ctx)
+}
+
+// cleanTempFiles removes the given temporary files unless skip_clean says
+// they should be kept for the outcome of this run.
+func (p *PostProcessor) cleanTempFiles(ui packer.Ui, paths []string, failed bool) {
+	if p.config.SkipClean == "always" || (p.config.SkipClean == "on_failure" && failed) {
+		for _, path := range paths {
+			ui.Message(fmt.Sprintf("Leaving temporary file in place: %s", path))
+		}
+		return
+	}
+
+	for _, path := range paths {
+		log.Printf("Removing temporary file: %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Error removing temporary file %s: %s", path, err)
+		}
+	}
 }
@@ -0,0 +1,1286 @@
+package shell
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+func testConfig(t *testing.T) map[string]interface{} {
+	return map[string]interface{}{
+		"inline": []interface{}{"true"},
+	}
+}
+
+func testScript(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path
+}
+
+// testUi is a packer.Ui recording everything said to it.
+type testUi struct {
+	sync.Mutex
+	said   []string
+	errors []string
+	answer string
+}
+
+func (u *testUi) Ask(query string) (string, error) {
+	u.Say(query)
+	return u.answer, nil
+}
+
+func (u *testUi) Say(message string) {
+	u.Lock()
+	defer u.Unlock()
+	u.said = append(u.said, message)
+}
+
+func (u *testUi) Message(message string) {
+	u.Say(message)
+}
+
+func (u *testUi) Error(message string) {
+	u.Lock()
+	defer u.Unlock()
+	u.errors = append(u.errors, message)
+}
+
+func (u *testUi) Machine(string, ...string) {}
+
+// testArtifact is a packer.Artifact with the given files and state.
+type testArtifact struct {
+	id        string
+	files     []string
+	state     map[string]interface{}
+	destroyed bool
+}
+
+func (a *testArtifact) BuilderId() string { return "test.builder" }
+func (a *testArtifact) Files() []string   { return a.files }
+func (a *testArtifact) Id() string        { return a.id }
+func (a *testArtifact) String() string    { return fmt.Sprintf("test artifact %s", a.id) }
+
+func (a *testArtifact) State(name string) interface{} {
+	return a.state[name]
+}
+
+func (a *testArtifact) Destroy() error {
+	a.destroyed = true
+	return nil
+}
+
+// testLogScript writes a script appending its name, and its first
+// argument if any, to the log file, exiting with the given code.
+func testLogScript(t *testing.T, dir, name, log string, code int) string {
+	return testScript(t, dir, name, fmt.Sprintf(
+		"#!/bin/sh\necho \"%s $1\" >> '%s'\nexit %d\n", name, log, code))
+}
+
+func testReadLog(t *testing.T, log string) []string {
+	contents, err := ioutil.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return lines
+}
+
+func TestPostProcessor_Impl(t *testing.T) {
+	var raw interface{}
+	raw = &PostProcessor{}
+	if _, ok := raw.(packer.PostProcessor); !ok {
+		t.Fatalf("must be a post processor")
+	}
+}
+
+func TestPostProcessorConfigure_scriptsMixed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := testScript(t, dir, "first.sh", "#!/bin/sh\n")
+	second := testScript(t, dir, "second.sh", "#!/bin/sh\n")
+	third := testScript(t, dir, "third.sh", "#!/bin/sh\n")
+
+	for _, key := range []string{"scripts", "steps"} {
+		config := map[string]interface{}{
+			key: []interface{}{
+				first,
+				map[string]interface{}{
+					"path":    second,
+					"retries": "2",
+				},
+				// Objects coming over RPC have interface{} keys
+				map[interface{}]interface{}{
+					"path":             third,
+					"environment_vars": []interface{}{"FOO=bar"},
+					"timeout":          "5m",
+				},
+			},
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("%s: err: %s", key, err)
+		}
+
+		scripts := p.config.scripts
+		if len(scripts) != 3 {
+			t.Fatalf("%s: bad: %#v", key, scripts)
+		}
+		if scripts[0].Path != first || scripts[1].Path != second || scripts[2].Path != third {
+			t.Fatalf("%s: bad paths: %#v", key, scripts)
+		}
+		if scripts[1].Retries == nil || *scripts[1].Retries != 2 {
+			t.Fatalf("%s: bad retries: %#v", key, scripts[1].Retries)
+		}
+		if len(scripts[2].Vars) != 1 || scripts[2].Vars[0] != "FOO=bar" {
+			t.Fatalf("%s: bad vars: %#v", key, scripts[2].Vars)
+		}
+		if scripts[2].timeout.Minutes() != 5 {
+			t.Fatalf("%s: bad timeout: %s", key, scripts[2].timeout)
+		}
+	}
+}
+
+func TestPostProcessorConfigure_scriptsInvalid(t *testing.T) {
+	cases := []interface{}{
+		42,
+		[]interface{}{"a"},
+		map[interface{}]interface{}{"environment_vars": []interface{}{"FOO"}},
+		map[interface{}]interface{}{"path": "a", "inline": []interface{}{"true"}},
+		map[string]interface{}{"path": "a", "script": "b"},
+		map[string]interface{}{"path": "a", "retries": -1},
+	}
+
+	for _, raw := range cases {
+		if _, err := decodeScript(raw); err == nil {
+			t.Fatalf("should error: %#v", raw)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_lifecycleOrder(t *testing.T) {
+	cases := []struct {
+		failing  string
+		expected []string
+	}{
+		{
+			"",
+			[]string{"setup", "before", "main", "after", "teardown"},
+		},
+		{
+			"setup",
+			[]string{"setup", "teardown"},
+		},
+		{
+			"before",
+			[]string{"setup", "before", "error", "teardown"},
+		},
+		{
+			"main",
+			[]string{"setup", "before", "main", "error", "teardown"},
+		},
+		{
+			"after",
+			[]string{"setup", "before", "main", "after", "error", "teardown"},
+		},
+	}
+
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		log := filepath.Join(dir, "log")
+		script := func(name string) string {
+			code := 0
+			if name == tc.failing {
+				code = 1
+			}
+			return testLogScript(t, dir, name, log, code)
+		}
+
+		config := map[string]interface{}{
+			"setup_script":    script("setup"),
+			"before_scripts":  []interface{}{script("before")},
+			"scripts":         []interface{}{script("main")},
+			"after_scripts":   []interface{}{script("after")},
+			"error_scripts":   []interface{}{script("error")},
+			"teardown_script": script("teardown"),
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file := filepath.Join(dir, "disk.img")
+		testScript(t, dir, "disk.img", "")
+		_, _, err = p.PostProcess(new(testUi), &testArtifact{files: []string{file}})
+		if (err != nil) != (tc.failing != "") {
+			t.Fatalf("%s: bad err: %v", tc.failing, err)
+		}
+
+		var ran []string
+		for _, line := range testReadLog(t, log) {
+			ran = append(ran, strings.Fields(line)[0])
+		}
+		if strings.Join(ran, " ") != strings.Join(tc.expected, " ") {
+			t.Fatalf("%s: bad order: %v", tc.failing, ran)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_lifecycleTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The sleep the script starts must be stopped along with it, or the
+	// run would wait for it to close the output.
+	setup := testScript(t, dir, "setup with space.sh", "#!/bin/sh\nsleep 30\n")
+	config := testConfig(t)
+	config["setup_script"] = setup
+	config["timeout"] = "100ms"
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	testScript(t, dir, "disk.img", "")
+	start := time.Now()
+	_, _, err = p.PostProcess(new(testUi), &testArtifact{files: []string{filepath.Join(dir, "disk.img")}})
+	if err == nil || !strings.Contains(err.Error(), "timeout of 100ms exceeded") {
+		t.Fatalf("bad: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("took too long: %s", time.Since(start))
+	}
+}
+
+func TestPostProcessorPostProcess_captureOutputNoClobber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "log")
+	config := map[string]interface{}{
+		"scripts": []interface{}{
+			testLogScript(t, dir, "first.sh", log, 0),
+			testLogScript(t, dir, "second.sh", log, 0),
+		},
+		"capture_output":            "{{.ArtifactDir}}/{{.Script}}-{{.ArtifactBase}}.log",
+		"capture_output_no_clobber": true,
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := []string{
+		testScript(t, dir, "a.img", ""),
+		testScript(t, dir, "b.img", ""),
+	}
+	artifact := &testArtifact{files: files}
+
+	if _, _, err := p.PostProcess(new(testUi), artifact); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, name := range []string{"first.sh-a.img.log", "second.sh-b.img.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	// Only the output of the last run is left in place, which must still
+	// stop any script from running again.
+	for _, name := range []string{"first.sh-a.img.log", "first.sh-b.img.log", "second.sh-a.img.log"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := os.Remove(log); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, _, err = p.PostProcess(new(testUi), artifact)
+	if err == nil || !strings.Contains(err.Error(), "second.sh-b.img.log") {
+		t.Fatalf("bad: %v", err)
+	}
+	if ran := testReadLog(t, log); len(ran) > 0 {
+		t.Fatalf("scripts ran: %v", ran)
+	}
+}
+
+func TestPostProcessorCheckCaptureOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testConfig(t)
+	config["capture_output"] = dir + "/{{.Script}}/{{.ArtifactBase}}.log"
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	scripts := []ScriptConfig{{Path: "/scripts/a.sh"}, {Path: "b.sh"}}
+	targets := []string{"/images/disk.img", "disk.vmx"}
+	if err := p.checkCaptureOutput(scripts, targets); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "b.sh"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	path := testScript(t, filepath.Join(dir, "b.sh"), "disk.vmx.log", "")
+	err = p.checkCaptureOutput(scripts, targets)
+	if err == nil || !strings.Contains(err.Error(), path) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestPostProcessorConfigure_shellArgv0(t *testing.T) {
+	cases := map[string]bool{
+		"/bin/sh":        true,
+		"bash":           true,
+		"cmd":            false,
+		"powershell.exe": false,
+		"pwsh":           false,
+	}
+
+	for shell, ok := range cases {
+		config := testConfig(t)
+		config["shell"] = []interface{}{shell}
+		config["shell_argv0"] = "wrapper"
+
+		var p PostProcessor
+		err := p.Configure(config)
+		if ok && err != nil && strings.Contains(err.Error(), "shell_argv0") {
+			t.Fatalf("%s: err: %s", shell, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "shell_argv0 requires a POSIX shell")) {
+			t.Fatalf("%s: should error: %v", shell, err)
+		}
+	}
+}
+
+func TestPostProcessorConfigure_keepOnFailure(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		config := testConfig(t)
+		config["keep_on_failure"] = keep
+
+		var p PostProcessor
+		err := p.Configure(config)
+		if !keep && err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if keep && (err == nil || !strings.Contains(err.Error(), "keep_on_failure is deprecated")) {
+			t.Fatalf("should error: %v", err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_shellArgv0(t *testing.T) {
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		t.Skip("needs /proc")
+	}
+
+	cases := []struct {
+		title string
+		argv0 string
+	}{
+		{"", "wrapper"},
+		{"packer-shell: {{.Script}}", "packer-shell: script.sh"},
+	}
+
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		out := filepath.Join(dir, "out")
+		config := map[string]interface{}{
+			"script":                 testScript(t, dir, "script.sh", "#!/bin/sh\n"),
+			"shell_argv0":            "wrapper",
+			"process_title_template": tc.title,
+			"execute_command": fmt.Sprintf(
+				`echo "$0" > '%s'; tr '\0' '\n' < /proc/$$/cmdline | head -n 1 >> '%s'`, out, out),
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file := testScript(t, dir, "disk.img", "")
+		if _, _, err := p.PostProcess(new(testUi), &testArtifact{files: []string{file}}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		lines := testReadLog(t, out)
+		if len(lines) != 2 || lines[0] != "wrapper" || lines[1] != tc.argv0 {
+			t.Fatalf("%q: bad: %q", tc.title, lines)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_dedupById(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The script fails until the flag file exists
+	log := filepath.Join(dir, "log")
+	flag := filepath.Join(dir, "flag")
+	script := testScript(t, dir, "script.sh", fmt.Sprintf(
+		"#!/bin/sh\necho \"id=$PACKER_ARTIFACT_ID\" >> '%s'\n[ -e '%s' ]\n", log, flag))
+	config := map[string]interface{}{
+		"script":      script,
+		"dedup_by_id": true,
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	file := testScript(t, dir, "disk.img", "")
+	run := func(id string) error {
+		_, _, err := p.PostProcess(new(testUi), &testArtifact{id: id, files: []string{file}})
+		return err
+	}
+
+	if err := run("a"); err == nil {
+		t.Fatal("should error")
+	}
+	testScript(t, dir, "flag", "")
+	for _, id := range []string{"a", "a", "b", "", "", "b", "a"} {
+		if err := run(id); err != nil {
+			t.Fatalf("%s: err: %s", id, err)
+		}
+	}
+
+	ran := strings.Join(testReadLog(t, log), ",")
+	if ran != "id=a,id=a,id=b,id=,id=" {
+		t.Fatalf("bad: %q", ran)
+	}
+}
+
+func TestPostProcessorPostProcess_executeModeOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "log")
+	script := testScript(t, dir, "script.sh", fmt.Sprintf(
+		"#!/bin/sh\nfor f in \"$@\"; do echo \"$f\" >> '%s'; done\n", log))
+	config := map[string]interface{}{
+		"script":       script,
+		"execute_mode": "once",
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := []string{
+		testScript(t, dir, "disk one.img", ""),
+		testScript(t, dir, "it's.img", ""),
+		testScript(t, dir, "disk.vmx", ""),
+	}
+	if _, _, err := p.PostProcess(new(testUi), &testArtifact{files: files}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	args := testReadLog(t, log)
+	if strings.Join(args, "\n") != strings.Join(files, "\n") {
+		t.Fatalf("bad: %q", args)
+	}
+}
+
+func TestPostProcessorPostProcess_globalMaxParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every run registers itself while it runs and logs how many were
+	// running at the time.
+	running := filepath.Join(dir, "running")
+	if err := os.Mkdir(running, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	log := filepath.Join(dir, "log")
+	script := testScript(t, dir, "script.sh", fmt.Sprintf(
+		"#!/bin/sh\ntouch '%[1]s'/$$\nls '%[1]s' | wc -l >> '%[2]s'\nsleep 0.05\nrm '%[1]s'/$$\n",
+		running, log))
+
+	const limit = 2
+	config := map[string]interface{}{
+		"script":              script,
+		"parallel":            true,
+		"parallel_jobs":       8,
+		"global_max_parallel": limit,
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := make([]string, 8)
+	for i := range files {
+		files[i] = testScript(t, dir, fmt.Sprintf("disk%d.img", i), "")
+	}
+
+	// The limit holds across builds post-processing at the same time
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := p.PostProcess(new(testUi), &testArtifact{files: files})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	counts := testReadLog(t, log)
+	if len(counts) != 3*len(files) {
+		t.Fatalf("bad: %v", counts)
+	}
+	for _, count := range counts {
+		if count != "1" && count != "2" {
+			t.Fatalf("more than %d scripts ran at once: %v", limit, counts)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_refreshOnRetry(t *testing.T) {
+	for _, refresh := range []bool{true, false} {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Every evaluation of TOKEN counts up, and the script only
+		// succeeds once it gets the third value.
+		counter := filepath.Join(dir, "counter")
+		log := filepath.Join(dir, "log")
+		script := testScript(t, dir, "script.sh", fmt.Sprintf(
+			"#!/bin/sh\necho \"$TOKEN $STATIC $STEP\" >> '%s'\n[ \"$TOKEN\" -ge 3 ]\n", log))
+		config := map[string]interface{}{
+			"scripts": []interface{}{
+				map[string]interface{}{
+					"path":             script,
+					"environment_vars": []interface{}{"STEP=step"},
+				},
+			},
+			"environment_vars": []interface{}{"STATIC=static"},
+			"dynamic_environment_vars": []interface{}{fmt.Sprintf(
+				"TOKEN=n=$(cat '%[1]s' 2>/dev/null || echo 0); echo $((n+1)) > '%[1]s'; cat '%[1]s'", counter)},
+			"refresh_on_retry": refresh,
+			"max_retries":      3,
+			"retry_delay":      "1ms",
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file := testScript(t, dir, "disk.img", "")
+		_, _, err = p.PostProcess(new(testUi), &testArtifact{files: []string{file}})
+
+		attempts := strings.Join(testReadLog(t, log), ",")
+		if refresh {
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if attempts != "1 static step,2 static step,3 static step" {
+				t.Fatalf("bad: %q", attempts)
+			}
+		} else {
+			if err == nil {
+				t.Fatal("should error")
+			}
+			if attempts != "1 static step,1 static step,1 static step,1 static step" {
+				t.Fatalf("bad: %q", attempts)
+			}
+		}
+	}
+}
+
+func TestBatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := func(name string, size int) string {
+		return testScript(t, dir, name, strings.Repeat("x", size))
+	}
+	a := file("a", 4)
+	b := file("b", 6)
+	c := file("c", 11)
+	d := file("d", 10)
+	e := file("e", 3)
+
+	cases := []struct {
+		files    []string
+		expected [][]string
+		messages int
+	}{
+		// The exact limit still fits in one batch
+		{[]string{a, b}, [][]string{{a, b}}, 0},
+		{[]string{a, b, e}, [][]string{{a, b}, {e}}, 0},
+		{[]string{d}, [][]string{{d}}, 0},
+
+		// A file over the limit is processed alone, between the others
+		{[]string{a, c, e}, [][]string{{a}, {c}, {e}}, 1},
+		{[]string{c}, [][]string{{c}}, 1},
+
+		{nil, nil, 0},
+	}
+
+	for _, tc := range cases {
+		ui := new(testUi)
+		batches, err := batchFiles(ui, tc.files, 10)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if fmt.Sprint(batches) != fmt.Sprint(tc.expected) {
+			t.Fatalf("%v: bad: %v", tc.files, batches)
+		}
+		if len(ui.said) != tc.messages {
+			t.Fatalf("%v: bad: %q", tc.files, ui.said)
+		}
+	}
+
+	if _, err := batchFiles(new(testUi), []string{filepath.Join(dir, "missing")}, 10); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestPostProcessorPostProcess_batchMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	log := filepath.Join(dir, "log")
+	script := testScript(t, dir, "script.sh", fmt.Sprintf(
+		"#!/bin/sh\necho \"$#:$*\" >> '%s'\n", log))
+	config := map[string]interface{}{
+		"script":          script,
+		"batch_max_bytes": 10,
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := []string{
+		testScript(t, dir, "disk one.img", "12345"),
+		testScript(t, dir, "disk two.img", "12345"),
+		testScript(t, dir, "disk.vmx", "1"),
+	}
+	if _, _, err := p.PostProcess(new(testUi), &testArtifact{files: files}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{
+		"2:" + files[0] + " " + files[1],
+		"1:" + files[2],
+	}
+	if lines := testReadLog(t, log); strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad: %q", lines)
+	}
+}
+
+func TestPostProcessorArtifactFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := testScript(t, dir, "a.img", "")
+	b := testScript(t, dir, "b.img", "")
+	missing := filepath.Join(dir, "missing.img")
+
+	artifact := &testArtifact{
+		files: []string{"files.img"},
+		state: map[string]interface{}{
+			"string":     a,
+			"strings":    []string{a, b},
+			"interfaces": []interface{}{b, a},
+			"empty":      []string{},
+			"blank":      "",
+			"mixed":      []interface{}{a, 1},
+			"number":     1,
+			"missing":    []string{a, missing},
+		},
+	}
+
+	cases := []struct {
+		source   string
+		expected []string
+		err      string
+	}{
+		{"files", []string{"files.img"}, ""},
+		{"state:string", []string{a}, ""},
+		{"state:strings", []string{a, b}, ""},
+		{"state:interfaces", []string{b, a}, ""},
+		{"state:empty", nil, "contains no paths"},
+		{"state:blank", nil, "contains no paths"},
+		{"state:mixed", nil, "non-path value"},
+		{"state:number", nil, "is not a path or list of paths"},
+		{"state:missing", nil, "Bad path in artifact state 'missing'"},
+		{"state:none", nil, "Artifact has no state 'none'"},
+	}
+
+	for _, tc := range cases {
+		var p PostProcessor
+		p.config.ArtifactSource = tc.source
+
+		files, err := p.artifactFiles(artifact)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%s: bad: %v", tc.source, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.source, err)
+		}
+		if strings.Join(files, "\n") != strings.Join(tc.expected, "\n") {
+			t.Fatalf("%s: bad: %q", tc.source, files)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_envValues(t *testing.T) {
+	value := "it's a \"quoted\" value\nwith $HOME, `backticks` and\ttabs "
+	commands := []string{
+		"",
+		"{{.Vars}} {{.QuotedPath}} {{.QuotedArtifact}}",
+	}
+
+	for _, command := range commands {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		out := filepath.Join(dir, "out")
+		script := testScript(t, dir, "script.sh", fmt.Sprintf(
+			"#!/bin/sh\nprintf '%%s' \"$VALUE\" > '%s'\n", out))
+		config := map[string]interface{}{
+			"script":           script,
+			"environment_vars": []interface{}{"VALUE=" + value},
+		}
+		if command != "" {
+			config["execute_command"] = command
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file := testScript(t, dir, "disk.img", "")
+		if _, _, err := p.PostProcess(new(testUi), &testArtifact{files: []string{file}}); err != nil {
+			t.Fatalf("%q: err: %s", command, err)
+		}
+
+		contents, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(contents) != value {
+			t.Fatalf("%q: bad: %q", command, contents)
+		}
+	}
+}
+
+func TestPostProcessorExecuteCommand(t *testing.T) {
+	envVars := []string{
+		"PACKER_ARTIFACT_ID=ami-1",
+		"PLAIN=value",
+		"QUOTES=it's \"here\"",
+		"SPACES=a b  c",
+		"NEWLINE=one\ntwo",
+		"EQUALS=a=b",
+	}
+
+	cases := []struct {
+		format   string
+		shell    []interface{}
+		expected string
+	}{
+		{
+			"",
+			nil,
+			`PACKER_ARTIFACT_ID='ami-1' PLAIN='value' QUOTES='it'"'"'s "here"' ` +
+				`SPACES='a b  c' NEWLINE='one` + "\n" + `two' EQUALS='a=b'|ami-1|'/art file.img'`,
+		},
+		{
+			"export %s=\"%s\";",
+			nil,
+			`export PACKER_ARTIFACT_ID="ami-1"; export PLAIN="value"; ` +
+				`export QUOTES="it's "here""; export SPACES="a b  c"; ` +
+				`export NEWLINE="one` + "\n" + `two"; export EQUALS="a=b";|ami-1|'/art file.img'`,
+		},
+		{
+			"",
+			[]interface{}{"powershell", "-Command"},
+			`PACKER_ARTIFACT_ID='ami-1' PLAIN='value' QUOTES='it''s "here"' ` +
+				`SPACES='a b  c' NEWLINE='one` + "\n" + `two' EQUALS='a=b'|ami-1|'/art file.img'`,
+		},
+		{
+			"$env:%s='%s';",
+			[]interface{}{"powershell", "-Command"},
+			`$env:PACKER_ARTIFACT_ID='ami-1'; $env:PLAIN='value'; ` +
+				`$env:QUOTES='it's "here"'; $env:SPACES='a b  c'; ` +
+				`$env:NEWLINE='one` + "\n" + `two'; $env:EQUALS='a=b';|ami-1|'/art file.img'`,
+		},
+	}
+
+	for _, tc := range cases {
+		config := testConfig(t)
+		config["execute_command"] = "{{.Vars}}|{{.ArtifactId}}|{{.QuotedArtifact}}"
+		if tc.format != "" {
+			config["env_var_format"] = tc.format
+		}
+		if tc.shell != nil {
+			config["shell"] = tc.shell
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		command, err := p.executeCommand("script.sh", envVars, "/art file.img")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if command != tc.expected {
+			t.Fatalf("%q:\nbad: %s\nexpected: %s", tc.format, command, tc.expected)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_outputLevel(t *testing.T) {
+	for _, level := range []string{"", "normal", "verbose", "quiet"} {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		config := map[string]interface{}{
+			"script": testScript(t, dir, "script.sh", "#!/bin/sh\necho hello\necho oops >&2\n"),
+		}
+		if level != "" {
+			config["output_level"] = level
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		ui := new(testUi)
+		file := testScript(t, dir, "disk.img", "")
+		if _, _, err := p.PostProcess(ui, &testArtifact{files: []string{file}}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		said := strings.Join(ui.said, "\n")
+		shown := strings.Contains(said, "\nhello\n") && strings.Join(ui.errors, "\n") == "oops"
+		if shown != (level != "quiet") {
+			t.Fatalf("%q: bad: %q %q", level, ui.said, ui.errors)
+		}
+		if strings.Contains(said, "Executing shell command") != (level == "verbose") {
+			t.Fatalf("%q: bad: %q", level, ui.said)
+		}
+	}
+}
+
+// flagUi is a testUi creating a file once it's told a given message.
+type flagUi struct {
+	testUi
+	message string
+	flag    string
+}
+
+func (u *flagUi) Message(message string) {
+	if message == u.message {
+		ioutil.WriteFile(u.flag, nil, 0644)
+	}
+	u.testUi.Message(message)
+}
+
+func TestPostProcessorPostProcess_outputMode(t *testing.T) {
+	cases := map[string]string{
+		"":         "flag seen",
+		"stream":   "flag seen",
+		"buffered": "no flag",
+	}
+
+	for mode, expected := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// The script only sees the flag if its first line reached the
+		// UI while it's still running.
+		flag := filepath.Join(dir, "flag")
+		script := testScript(t, dir, "script.sh", fmt.Sprintf(`#!/bin/sh
+echo first
+i=0
+while [ $i -lt 20 ]; do
+  if [ -e '%s' ]; then echo "flag seen"; exit 0; fi
+  sleep 0.05
+  i=$((i+1))
+done
+echo "no flag"
+`, flag))
+		config := map[string]interface{}{"script": script}
+		if mode != "" {
+			config["output_mode"] = mode
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		ui := &flagUi{message: "first", flag: flag}
+		file := testScript(t, dir, "disk.img", "")
+		if _, _, err := p.PostProcess(ui, &testArtifact{files: []string{file}}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		said := strings.Join(ui.said, "\n")
+		if !strings.Contains(said, "\nfirst\n"+expected+"\n") {
+			t.Fatalf("%q: bad: %q", mode, ui.said)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_secretVarsOffCommandLine(t *testing.T) {
+	secret := "it's a\nsecret"
+	t.Setenv("TEST_SECRET", secret)
+
+	for _, mode := range []string{"use_sudo", "remote"} {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Stand-ins for sudo, ssh and scp that record their arguments
+		args := filepath.Join(dir, "args")
+		bin := filepath.Join(dir, "bin")
+		if err := os.Mkdir(bin, 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		testScript(t, bin, "sudo", fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" >> '%s'
+while [ $# -gt 0 ]; do case $1 in -u) shift 2;; -*) shift;; *) break;; esac; done
+exec "$@"
+`, args))
+		testScript(t, bin, "ssh", fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" >> '%s'
+for a; do last=$a; done
+exec sh -c "$last"
+`, args))
+		testScript(t, bin, "scp", fmt.Sprintf(`#!/bin/sh
+printf '%%s\n' "$@" >> '%s'
+for a; do src=$dst; dst=$a; done
+cp "$src" "${dst#*:}"
+`, args))
+		t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+		out := filepath.Join(dir, "out")
+		remoteDir := filepath.Join(dir, "remote")
+		if err := os.Mkdir(remoteDir, 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		config := map[string]interface{}{
+			"script": testScript(t, dir, "script.sh", fmt.Sprintf(
+				"#!/bin/sh\nprintf '%%s %%s %%s' \"$SECRET\" \"$FOO\" \"$(cat)\" > '%s'\n", out)),
+			"environment_vars": []interface{}{"FOO=bar"},
+			"secret_vars":      map[string]interface{}{"SECRET": "env://TEST_SECRET"},
+			"stdin":            "input",
+		}
+		if mode == "use_sudo" {
+			config["use_sudo"] = true
+		} else {
+			config["remote"] = map[string]interface{}{"host": "example.com", "dir": remoteDir}
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("%s: err: %s", mode, err)
+		}
+
+		file := testScript(t, dir, "disk.img", "")
+		if _, _, err := p.PostProcess(new(testUi), &testArtifact{files: []string{file}}); err != nil {
+			t.Fatalf("%s: err: %s", mode, err)
+		}
+
+		contents, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(contents) != secret+" bar input" {
+			t.Fatalf("%s: bad: %q", mode, contents)
+		}
+
+		contents, err = ioutil.ReadFile(args)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !strings.Contains(string(contents), "FOO=bar") || strings.Contains(string(contents), "secret") {
+			t.Fatalf("%s: bad: %q", mode, contents)
+		}
+
+		left, err := ioutil.ReadDir(remoteDir)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if len(left) != 0 {
+			t.Fatalf("%s: left on the remote: %v", mode, left)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_expectOutput(t *testing.T) {
+	cases := map[string]string{
+		"^ready$": "",
+		"^done$":  "stdout did not match expect_stdout_regex '^done$': ready",
+	}
+
+	for pattern, expected := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		config := map[string]interface{}{
+			"script":        testScript(t, dir, "script.sh", "#!/bin/sh\necho ready\n"),
+			"expect_output": pattern,
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file := testScript(t, dir, "disk.img", "")
+		_, _, err = p.PostProcess(new(testUi), &testArtifact{files: []string{file}})
+		if expected == "" {
+			if err != nil {
+				t.Fatalf("%q: err: %s", pattern, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("%q: bad: %v", pattern, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_reverse(t *testing.T) {
+	cases := map[bool]string{
+		false: "a\nb\nc\n",
+		true:  "c\nb\na\n",
+	}
+
+	for reverse, expected := range cases {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		order := filepath.Join(dir, "order")
+		config := map[string]interface{}{
+			"script": testScript(t, dir, "script.sh", fmt.Sprintf(
+				"#!/bin/sh\nbasename \"$1\" >> '%s'\n", order)),
+			"reverse": reverse,
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		var files []string
+		for _, name := range []string{"a", "b", "c"} {
+			files = append(files, testScript(t, dir, name, ""))
+		}
+		if _, _, err := p.PostProcess(new(testUi), &testArtifact{files: files}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		contents, err := ioutil.ReadFile(order)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(contents) != expected {
+			t.Fatalf("%t: bad: %q", reverse, contents)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_compensationScript(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "packer")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		status := 0
+		if fail {
+			status = 1
+		}
+		out := filepath.Join(dir, "out")
+		script := testScript(t, dir, "script.sh", fmt.Sprintf("#!/bin/sh\nexit %d\n", status))
+		config := map[string]interface{}{
+			"script": script,
+			"compensation_script": testScript(t, dir, "compensate.sh", fmt.Sprintf(
+				"#!/bin/sh\necho \"$PACKER_SHELL_FAILED_SCRIPT $PACKER_SHELL_FAILED_FILE\" > '%s'\n", out)),
+		}
+
+		var p PostProcessor
+		if err := p.Configure(config); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		file := testScript(t, dir, "disk.img", "")
+		_, _, err = p.PostProcess(new(testUi), &testArtifact{files: []string{file}})
+		if (err != nil) != fail {
+			t.Fatalf("%t: err: %v", fail, err)
+		}
+
+		contents, err := ioutil.ReadFile(out)
+		if !fail {
+			if !os.IsNotExist(err) {
+				t.Fatalf("compensation script ran on success: %q %v", contents, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if string(contents) != script+" "+file+"\n" {
+			t.Fatalf("bad: %q", contents)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_junitReportExcluded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	report := filepath.Join(dir, "report.xml")
+	config := testConfig(t)
+	config["only_builder_ids"] = []interface{}{"other"}
+	config["junit_report"] = report
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := []string{filepath.Join(dir, "disk.img"), filepath.Join(dir, "disk.vmx")}
+	artifact := &testArtifact{id: "a", files: files}
+	result, keep, err := p.PostProcess(new(testUi), artifact)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if result != artifact || !keep {
+		t.Fatalf("bad: %#v %t", result, keep)
+	}
+
+	contents, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{
+		`tests="2" failures="0" skipped="2"`,
+		`<testcase classname="shell" name="` + files[0] + `" time="0.000">`,
+		`<testcase classname="shell" name="` + files[1] + `" time="0.000">`,
+		`<skipped message="Skipping artifact from builder: test.builder"></skipped>`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(string(contents), e) {
+			t.Fatalf("missing %q in %s", e, contents)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package shell
+
+import (
+	"os"
+	"os/exec"
+)
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// Processes can't be grouped on Windows; only the command itself is
+// stopped on timeout or interrupt.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Windows has no SIGTERM to send, so the command is killed right away.
+func terminateProcessGroup(pid int) error {
+	return killProcessGroup(pid)
+}
+
+func killProcessGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
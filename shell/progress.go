@@ -0,0 +1,65 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// progressRe matches the lines scripts print to report their progress,
+// such as "PACKER_SHELL_SET progress=42".
+var progressRe = regexp.MustCompile(`^PACKER_SHELL_SET progress=([0-9]{1,3})\s*$`)
+
+// progressWriter passes everything written to it through to another
+// writer while watching for progress lines, reporting each change in
+// progress to the UI.
+type progressWriter struct {
+	w      io.Writer
+	ui     packer.Ui
+	prefix string
+
+	mu   sync.Mutex
+	line bytes.Buffer
+	last int
+}
+
+func newProgressWriter(w io.Writer, ui packer.Ui, prefix string) *progressWriter {
+	return &progressWriter{w: w, ui: ui, prefix: prefix, last: -1}
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range data {
+		if b != '\n' {
+			p.line.WriteByte(b)
+			continue
+		}
+
+		p.check(p.line.String())
+		p.line.Reset()
+	}
+
+	return p.w.Write(data)
+}
+
+func (p *progressWriter) check(line string) {
+	m := progressRe.FindStringSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n > 100 || n == p.last {
+		return
+	}
+
+	p.last = n
+	p.ui.Message(fmt.Sprintf("%s: %d%%", p.prefix, n))
+}
@@ -0,0 +1,71 @@
+package shell
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// scriptTerminal is a pseudo-terminal a command is connected to in place
+// of pipes, for tools that refuse to run without one. The command's
+// stdin, stdout and stderr are all the terminal; what it prints is copied
+// to out, and in is typed into it.
+type scriptTerminal struct {
+	master *os.File
+	tty    *os.File
+	out    io.Writer
+	in     io.Reader
+	copied chan struct{}
+}
+
+// newScriptTerminal opens a pseudo-terminal and connects cmd to it,
+// sending its output to where cmd.Stdout went.
+func newScriptTerminal(cmd *exec.Cmd, in io.Reader) (*scriptTerminal, error) {
+	master, tty, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &scriptTerminal{
+		master: master,
+		tty:    tty,
+		out:    cmd.Stdout,
+		in:     in,
+		copied: make(chan struct{}),
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	setControllingTerminal(cmd)
+	return t, nil
+}
+
+// start copies to and from the terminal once the command started.
+func (t *scriptTerminal) start() {
+	// Reading the output only ends once every process holding the
+	// terminal is gone, including us.
+	t.tty.Close()
+
+	go func() {
+		defer close(t.copied)
+		io.Copy(t.out, t.master)
+	}()
+
+	if t.in != nil {
+		go func() {
+			if _, err := io.Copy(t.master, t.in); err != nil {
+				log.Printf("Error writing stdin to terminal: %s", err)
+			}
+		}()
+	}
+}
+
+// wait waits for the output of the started command to be copied.
+func (t *scriptTerminal) wait() {
+	<-t.copied
+}
+
+// close closes the terminal.
+func (t *scriptTerminal) close() {
+	t.tty.Close()
+	t.master.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pty is only supported on Linux")
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {}
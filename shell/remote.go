@@ -0,0 +1,187 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// RemoteConfig is where the scripts run when they run on another machine
+// over SSH rather than locally. The ssh and scp commands do the work, so
+// their own configuration, such as known hosts, applies as usual.
+type RemoteConfig struct {
+	Host           string `mapstructure:"host"`
+	Port           int    `mapstructure:"port"`
+	User           string `mapstructure:"user"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+
+	// Passwords are passed to sshpass, which must be installed.
+	Password string `mapstructure:"password"`
+
+	// The directory on the remote machine the scripts, and with
+	// upload_files the artifact files, are uploaded to. Defaults to /tmp.
+	Dir string `mapstructure:"dir"`
+
+	// Upload each artifact file along with the script, passing the
+	// script the uploaded copy.
+	UploadFiles bool `mapstructure:"upload_files"`
+}
+
+// remoteCount numbers the uploads so concurrent runs don't overwrite each
+// other's files.
+var remoteCount int64
+
+func (r *RemoteConfig) prepare() []error {
+	var errs []error
+	if r.Host == "" {
+		errs = append(errs, errors.New("remote requires host to be set"))
+	}
+	if r.Port == 0 {
+		r.Port = 22
+	}
+	if r.Dir == "" {
+		r.Dir = "/tmp"
+	}
+	if r.Password != "" && r.PrivateKeyFile != "" {
+		errs = append(errs, errors.New("Only one of remote password or private_key_file can be specified."))
+	}
+	if r.Password != "" {
+		if _, err := exec.LookPath("sshpass"); err != nil {
+			errs = append(errs, errors.New("remote password requires sshpass to be installed"))
+		}
+	}
+	return errs
+}
+
+// target returns the user@host to connect to.
+func (r *RemoteConfig) target() string {
+	if r.User == "" {
+		return r.Host
+	}
+	return r.User + "@" + r.Host
+}
+
+// command returns a command running name with the connection options,
+// passed with portFlag for the port since ssh and scp disagree on it.
+func (r *RemoteConfig) command(ctx context.Context, name string, portFlag string, args ...string) *exec.Cmd {
+	opts := []string{portFlag, strconv.Itoa(r.Port)}
+	if r.PrivateKeyFile != "" {
+		opts = append(opts, "-i", r.PrivateKeyFile)
+	}
+
+	// Nobody is there to answer a prompt
+	if r.Password == "" {
+		opts = append(opts, "-o", "BatchMode=yes")
+	}
+
+	args = append(opts, args...)
+	if r.Password != "" {
+		return exec.CommandContext(ctx, "sshpass", append([]string{"-e", name}, args...)...)
+	}
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// env returns the variables the ssh and scp commands need on top of the
+// environment.
+func (r *RemoteConfig) env() []string {
+	if r.Password == "" {
+		return nil
+	}
+	return []string{"SSHPASS=" + r.Password}
+}
+
+// upload copies the local file to a new path in the remote directory,
+// returning that path.
+func (r *RemoteConfig) upload(ctx context.Context, local string) (string, error) {
+	n := atomic.AddInt64(&remoteCount, 1)
+	remote := path.Join(r.Dir, fmt.Sprintf("packer-shell-%d-%s", n, filepath.Base(local)))
+
+	log.Printf("Uploading %s to %s:%s", local, r.Host, remote)
+	cmd := r.command(ctx, "scp", "-P", "-q", local, r.target()+":"+remote)
+	cmd.Env = append(os.Environ(), r.env()...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return remote, nil
+}
+
+// remoteCommand uploads the script, and with upload_files the artifact
+// file, then returns a command running execute_command for them on the
+// remote machine with the given environment variables. Whatever was
+// uploaded is removed again once the script is done.
+func (p *PostProcessor) remoteCommand(ctx context.Context, ui packer.Ui, script string, art string, envVars []string) (*exec.Cmd, error) {
+	r := p.config.Remote
+	ui.Message(fmt.Sprintf("Uploading script to %s: %s", r.Host, script))
+	remoteScript, err := r.upload(ctx, script)
+	if err != nil {
+		return nil, fmt.Errorf("Error uploading script: %s", err)
+	}
+	uploaded := []string{remoteScript}
+
+	if r.UploadFiles {
+		ui.Message(fmt.Sprintf("Uploading artifact file to %s: %s", r.Host, art))
+		if art, err = r.upload(ctx, art); err != nil {
+			return nil, fmt.Errorf("Error uploading artifact file: %s", err)
+		}
+		uploaded = append(uploaded, art)
+	}
+
+	// The secret_vars are set from a file only the remote user can read,
+	// which is removed as soon as they are.
+	vars, secrets := p.splitSecretVars(envVars)
+	var secretsFile string
+	if len(secrets) > 0 {
+		if secretsFile, err = p.uploadSecretVars(ctx, secrets); err != nil {
+			return nil, fmt.Errorf("Error uploading secret_vars: %s", err)
+		}
+		uploaded = append(uploaded, secretsFile)
+	}
+
+	command, err := p.executeCommand(remoteScript, envVars, art)
+	if err != nil {
+		return nil, fmt.Errorf("Error processing execute_command: %s", err)
+	}
+
+	// The remote shell keeps the exit code of the script while cleaning up
+	cleanup := make([]string, len(uploaded))
+	for i, f := range uploaded {
+		cleanup[i] = shellQuote(f)
+	}
+	command = fmt.Sprintf("%s\nstatus=$?; rm -f %s; exit $status", command, strings.Join(cleanup, " "))
+
+	for i, kv := range vars {
+		vars[i] = shellQuote(kv)
+	}
+
+	remote := fmt.Sprintf("env %s sh -c %s", strings.Join(vars, " "), shellQuote(command))
+	if secretsFile != "" {
+		remote = fmt.Sprintf("sh -c %s %s %s", shellQuote(sourceSecretVars), shellQuote(secretsFile), remote)
+	}
+	log.Printf("Executing remote command on %s: %s", r.Host, command)
+	return r.command(ctx, "ssh", "-p", r.target(), remote), nil
+}
+
+// sourceSecretVars is run by sh ahead of the command in its arguments,
+// exporting the variables in the file given as $0 and removing it.
+const sourceSecretVars = `set -a; . "$0"; set +a; rm -f "$0"; exec "$@"`
+
+// uploadSecretVars uploads a file setting the secret variables when
+// sourced, returning its path. scp keeps it readable only by the user.
+func (p *PostProcessor) uploadSecretVars(ctx context.Context, secrets []string) (string, error) {
+	path, err := p.writeEnvFile(secrets)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path)
+	return p.config.Remote.upload(ctx, path)
+}
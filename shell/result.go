@@ -0,0 +1,166 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// scriptResult records the outcome of running a script against an
+// artifact file.
+type scriptResult struct {
+	Script   string
+	File     string
+	Matrix   string
+	Argv     []string
+	Start    time.Time
+	Duration time.Duration
+	Stdout   string
+	Stderr   string
+	Err      error
+
+	// Skipped is set for combinations that never ran because an earlier
+	// script failed, and for the files of artifacts the filters excluded,
+	// which have no Script but say why in SkipReason.
+	Skipped    bool
+	SkipReason string
+}
+
+// errorOutputLines is how many of the last lines of a failed script's
+// stdout and stderr are included in its error.
+const errorOutputLines = 20
+
+// ScriptError is the error of a script that exited with a code that isn't
+// one of the valid ones. It carries the script's full output, while the
+// error message only includes the end of it.
+type ScriptError struct {
+	Path     string
+	ExitCode int
+	Valid    []int
+	Stdout   string
+	Stderr   string
+}
+
+func (e *ScriptError) Error() string {
+	msg := fmt.Sprintf("Error executing script %s (exit code %d, valid exit codes %v)",
+		e.Path, e.ExitCode, e.Valid)
+
+	// Plenty of tools report their problems on stdout rather than stderr
+	if e.Stdout != "" {
+		msg += "\nstdout:\n" + tailLines(e.Stdout, errorOutputLines)
+	}
+	if e.Stderr != "" {
+		msg += "\nstderr:\n" + tailLines(e.Stderr, errorOutputLines)
+	}
+	return msg
+}
+
+// tailLines returns the last n lines of s, marking whether any were left
+// out.
+func tailLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return "...\n" + strings.Join(lines[len(lines)-n:], "\n")
+}
+
+// runResults collects the results of the script runs during a single
+// PostProcess call. Only the failures are kept, along with how many runs
+// there were, unless keepAll is set because the reports need every result:
+// with many artifact files the results would otherwise pile up.
+type runResults struct {
+	sync.Mutex
+	keepAll  bool
+	ran      int
+	failures []scriptResult
+	results  []scriptResult
+
+	// The checksums computed with compute_checksum, by artifact file and
+	// then by algorithm.
+	checksums map[string]map[string]string
+}
+
+func (r *runResults) add(result scriptResult) {
+	r.Lock()
+	defer r.Unlock()
+	if !result.Skipped {
+		r.ran++
+	}
+	if result.Err != nil {
+		r.failures = append(r.failures, result)
+	}
+	if r.keepAll {
+		r.results = append(r.results, result)
+	}
+}
+
+func (r *runResults) addChecksums(file string, sums map[string]string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.checksums == nil {
+		r.checksums = make(map[string]map[string]string)
+	}
+	r.checksums[file] = sums
+}
+
+func (r *runResults) allChecksums() map[string]map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	checksums := make(map[string]map[string]string, len(r.checksums))
+	for file, sums := range r.checksums {
+		checksums[file] = sums
+	}
+	return checksums
+}
+
+// failed reports whether any script run failed.
+func (r *runResults) failed() bool {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.failures) > 0
+}
+
+// failedResults returns the results of the script runs that failed, in
+// the order they finished.
+func (r *runResults) failedResults() []scriptResult {
+	r.Lock()
+	defer r.Unlock()
+	failures := make([]scriptResult, len(r.failures))
+	copy(failures, r.failures)
+	return failures
+}
+
+// all returns every result, which is only kept with keepAll.
+func (r *runResults) all() []scriptResult {
+	r.Lock()
+	defer r.Unlock()
+	results := make([]scriptResult, len(r.results))
+	copy(results, r.results)
+	return results
+}
+
+// reportFailures tells the UI how many script runs failed and which ones,
+// if any did.
+func (r *runResults) reportFailures(ui packer.Ui) {
+	failed := r.failedResults()
+	if len(failed) == 0 {
+		return
+	}
+
+	r.Lock()
+	ran := r.ran
+	r.Unlock()
+
+	ui.Error(fmt.Sprintf("%d of %d script runs failed:", len(failed), ran))
+	for _, result := range failed {
+		name := fmt.Sprintf("%s %s", result.Script, result.File)
+		if result.Matrix != "" {
+			name = fmt.Sprintf("[%s] %s", result.Matrix, name)
+		}
+		ui.Error(fmt.Sprintf("  %s: %s", name, result.Err))
+	}
+}
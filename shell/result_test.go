@@ -0,0 +1,194 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReportFailures(t *testing.T) {
+	results := []scriptResult{
+		{Script: "a.sh", File: "disk.img"},
+		{Script: "b.sh", File: "disk.img", Err: errors.New("exit 1")},
+		{Script: "a.sh", File: "disk.vmx", Matrix: "debian"},
+		{Script: "b.sh", File: "disk.vmx", Matrix: "debian", Err: errors.New("exit 2")},
+		{Script: "c.sh", File: "disk.vmx", Skipped: true},
+	}
+
+	var r runResults
+	for _, result := range results {
+		r.add(result)
+	}
+
+	ui := new(testUi)
+	r.reportFailures(ui)
+
+	expected := []string{
+		"2 of 4 script runs failed:",
+		"  b.sh disk.img: exit 1",
+		"  [debian] b.sh disk.vmx: exit 2",
+	}
+	if strings.Join(ui.errors, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad: %q", ui.errors)
+	}
+}
+
+func TestReportFailures_none(t *testing.T) {
+	results := []scriptResult{
+		{Script: "a.sh", File: "disk.img"},
+		{Script: "b.sh", File: "disk.img", Skipped: true},
+	}
+
+	var r runResults
+	for _, result := range results {
+		r.add(result)
+	}
+
+	ui := new(testUi)
+	r.reportFailures(ui)
+	if len(ui.errors) > 0 || len(ui.said) > 0 {
+		t.Fatalf("bad: %q %q", ui.said, ui.errors)
+	}
+}
+
+func TestPostProcessorPostProcess_reportFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := map[string]interface{}{
+		"scripts": []interface{}{
+			testScript(t, dir, "ok.sh", "#!/bin/sh\n"),
+			testScript(t, dir, "fail.sh", "#!/bin/sh\ncase \"$1\" in *b.img) exit 3;; esac\n"),
+		},
+		"parallel": true,
+	}
+
+	var p PostProcessor
+	if err := p.Configure(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := []string{
+		testScript(t, dir, "a.img", ""),
+		testScript(t, dir, "b.img", ""),
+	}
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, &testArtifact{files: files}); err == nil {
+		t.Fatal("should error")
+	}
+
+	if len(ui.errors) < 2 || ui.errors[0] != "1 of 4 script runs failed:" ||
+		!strings.HasPrefix(ui.errors[1], "  "+filepath.Join(dir, "fail.sh")+" "+files[1]+": ") {
+		t.Fatalf("bad: %q", ui.errors)
+	}
+}
+
+func TestRunResults(t *testing.T) {
+	for _, keepAll := range []bool{false, true} {
+		r := runResults{keepAll: keepAll}
+		for i := 0; i < 1000; i++ {
+			result := scriptResult{Script: "a.sh", File: fmt.Sprintf("disk%d.img", i), Stdout: "output"}
+			if i == 500 {
+				result.Err = errors.New("exit 1")
+			}
+			r.add(result)
+		}
+		r.add(scriptResult{Script: "b.sh", File: "disk500.img", Skipped: true})
+
+		failed := r.failedResults()
+		if !r.failed() || len(failed) != 1 || failed[0].File != "disk500.img" {
+			t.Fatalf("%t: bad: %#v", keepAll, failed)
+		}
+		if r.ran != 1000 {
+			t.Fatalf("%t: bad: %d", keepAll, r.ran)
+		}
+
+		// Only the reports need every result
+		expected := 0
+		if keepAll {
+			expected = 1001
+		}
+		if all := r.all(); len(all) != expected {
+			t.Fatalf("%t: bad: %d", keepAll, len(all))
+		}
+	}
+}
+
+func BenchmarkPostProcessManyFiles(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("files=%d", n), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "packer")
+			if err != nil {
+				b.Fatalf("err: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			files := make([]string, n)
+			for i := range files {
+				files[i] = filepath.Join(dir, fmt.Sprintf("file%d", i))
+				if err := ioutil.WriteFile(files[i], nil, 0644); err != nil {
+					b.Fatalf("err: %s", err)
+				}
+			}
+
+			config := map[string]interface{}{
+				"inline":          []interface{}{"echo output"},
+				"execute_command": "true",
+			}
+			var p PostProcessor
+			if err := p.Configure(config); err != nil {
+				b.Fatalf("err: %s", err)
+			}
+
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			// The heap is sampled while the scripts run. It stays flat when
+			// what's held for each file isn't kept once the file is done.
+			var peak uint64
+			done := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				ticker := time.NewTicker(10 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					var stats runtime.MemStats
+					runtime.ReadMemStats(&stats)
+					if stats.HeapInuse > peak {
+						peak = stats.HeapInuse
+					}
+					select {
+					case <-done:
+						return
+					case <-ticker.C:
+					}
+				}
+			}()
+
+			artifact := &testArtifact{files: files}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := p.PostProcess(new(testUi), artifact); err != nil {
+					b.Fatalf("err: %s", err)
+				}
+			}
+			b.StopTimer()
+			close(done)
+			<-sampled
+
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
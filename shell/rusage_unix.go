@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// peakMemoryKB returns the peak resident set size of the exited process
+// in kilobytes, if the platform reports it.
+func peakMemoryKB(state *os.ProcessState) (int64, bool) {
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0, false
+	}
+
+	// macOS reports bytes where everyone else reports kilobytes
+	maxrss := int64(ru.Maxrss)
+	if runtime.GOOS == "darwin" {
+		maxrss /= 1024
+	}
+	return maxrss, true
+}
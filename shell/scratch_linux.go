@@ -0,0 +1,15 @@
+package shell
+
+import "syscall"
+
+func mountTmpfs(dir string, size string) error {
+	var data string
+	if size != "" {
+		data = "size=" + size
+	}
+	return syscall.Mount("tmpfs", dir, "tmpfs", 0, data)
+}
+
+func unmountTmpfs(dir string) error {
+	return syscall.Unmount(dir, 0)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import "errors"
+
+func mountTmpfs(dir string, size string) error {
+	return errors.New("tmpfs is only supported on Linux")
+}
+
+func unmountTmpfs(dir string) error {
+	return nil
+}
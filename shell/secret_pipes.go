@@ -0,0 +1,114 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// secretPipes is a set of named pipes, each of which delivers a single
+// secret to the first process that opens it for reading. The secrets
+// never touch the disk or the environment of the script; only the paths
+// of the pipes are exposed.
+type secretPipes struct {
+	dir   string
+	paths map[string]string
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// newSecretPipes creates a pipe for every secret in a new directory in
+// tmpDir, keyed by the name of the environment variable that will hold
+// the pipe's path.
+func newSecretPipes(tmpDir string, secrets map[string]string) (*secretPipes, error) {
+	dir, err := ioutil.TempDir(tmpDir, "packer-shell-secrets")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &secretPipes{
+		dir:   dir,
+		paths: make(map[string]string),
+		done:  make(chan struct{}),
+	}
+
+	for name, secret := range secrets {
+		path := filepath.Join(dir, name)
+		if err := mkfifo(path); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Error creating secret pipe %s: %s", name, err)
+		}
+		s.paths[name] = path
+
+		s.wg.Add(1)
+		go s.serve(name, path, secret)
+	}
+
+	return s, nil
+}
+
+// serve waits for a reader to open the pipe and writes the secret to it
+// exactly once. It gives up when the pipes are closed.
+func (s *secretPipes) serve(name, path, secret string) {
+	defer s.wg.Done()
+
+	for {
+		f, err := openFifoWriter(path)
+		if err != nil {
+			log.Printf("Error opening secret pipe %s: %s", name, err)
+			return
+		}
+
+		if f != nil {
+			defer f.Close()
+			if err := writeFull(f, secret); err != nil {
+				log.Printf("Error writing secret pipe %s: %s", name, err)
+			}
+			return
+		}
+
+		// Nobody is reading yet
+		select {
+		case <-s.done:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// writeFull writes all of s to w, carrying on after short writes, so the
+// reader never gets a truncated secret.
+func writeFull(w io.Writer, s string) error {
+	b := []byte(s)
+	for len(b) > 0 {
+		n, err := w.Write(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Env returns the environment variables pointing at the pipes.
+func (s *secretPipes) Env() []string {
+	env := make([]string, 0, len(s.paths))
+	for name, path := range s.paths {
+		env = append(env, fmt.Sprintf("%s=%s", name, path))
+	}
+	return env
+}
+
+// Close stops serving secrets that were never read and removes the
+// pipes. The pipes hold no data on disk, so they are always removed
+// regardless of skip_clean.
+func (s *secretPipes) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return os.RemoveAll(s.dir)
+}
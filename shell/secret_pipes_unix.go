@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"os"
+	"syscall"
+)
+
+func mkfifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
+
+// openFifoWriter opens the pipe for writing without blocking. It returns a
+// nil file if no process has the pipe open for reading yet. Once there is
+// a reader, writes block again, so a secret larger than the pipe buffer
+// waits for the reader rather than failing with EAGAIN.
+func openFifoWriter(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := syscall.SetNonblock(int(f.Fd()), false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSecretPipes_large(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Well over the 64 KiB a pipe buffers on Linux
+	secret := strings.Repeat("0123456789abcdef", 16*1024)
+	pipes, err := newSecretPipes(dir, map[string]string{"SECRET": secret})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer pipes.Close()
+
+	contents, err := ioutil.ReadFile(pipes.paths["SECRET"])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(contents) != secret {
+		t.Fatalf("bad: read %d bytes of %d", len(contents), len(secret))
+	}
+}
@@ -0,0 +1,16 @@
+package shell
+
+import (
+	"errors"
+	"os"
+)
+
+var errSecretPipesUnsupported = errors.New("secret_pipes is not supported on Windows")
+
+func mkfifo(path string) error {
+	return errSecretPipesUnsupported
+}
+
+func openFifoWriter(path string) (*os.File, error) {
+	return nil, errSecretPipesUnsupported
+}
@@ -0,0 +1,231 @@
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// parseSecretSource splits a secret_vars source into its scheme, one of
+// "env", "file" or "vault", and the rest.
+func parseSecretSource(source string) (string, string, error) {
+	parts := strings.SplitN(source, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.New("must be in format 'scheme://location'")
+	}
+
+	switch parts[0] {
+	case "env", "file":
+	case "vault":
+		vs := strings.SplitN(parts[1], "#", 2)
+		if len(vs) != 2 || vs[0] == "" || vs[1] == "" {
+			return "", "", errors.New("must be in format 'vault://path#key'")
+		}
+	default:
+		return "", "", fmt.Errorf("scheme must be one of 'env', 'file' or 'vault': %s", parts[0])
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// fetchSecretVars fetches every secret in secret_vars, returning them as
+// "key=value" environment variables along with the secret values.
+func (p *PostProcessor) fetchSecretVars() ([]string, []string, error) {
+	names := make([]string, 0, len(p.config.SecretVars))
+	for name := range p.config.SecretVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]string, 0, len(names))
+	secrets := make([]string, 0, len(names))
+	for _, name := range names {
+		secret, err := fetchSecret(p.config.SecretVars[name])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error fetching secret for %s: %s", name, err)
+		}
+		vars = append(vars, fmt.Sprintf("%s=%s", name, secret))
+		secrets = append(secrets, secret)
+	}
+
+	return vars, secrets, nil
+}
+
+// fetchSecret fetches the secret a secret_vars source points at. Files
+// have trailing newlines removed.
+func fetchSecret(source string) (string, error) {
+	scheme, location, err := parseSecretSource(source)
+	if err != nil {
+		return "", err
+	}
+
+	switch scheme {
+	case "env":
+		secret, ok := os.LookupEnv(location)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", location)
+		}
+		return secret, nil
+	case "file":
+		b, err := ioutil.ReadFile(location)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	default:
+		vs := strings.SplitN(location, "#", 2)
+		return fetchVaultSecret(vs[0], vs[1])
+	}
+}
+
+// fetchVaultSecret reads key of the Vault secret at path, using the
+// address, token and namespace from the environment the way the vault CLI
+// does. Secrets of both version 1 and version 2 KV engines are read;
+// for version 2 the path includes "data/".
+func fetchVaultSecret(path string, key string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			b, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+			if err == nil {
+				token = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if token == "" {
+		return "", errors.New("VAULT_TOKEN is not set and there is no ~/.vault-token")
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", fmt.Errorf("reading %s from Vault: %s", path, resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("reading %s from Vault: %s", path, err)
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no key %s", path, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// sensitiveValues returns the values of the environment variables named
+// by sensitive_vars, whether set for every script, for a single one or
+// for a matrix entry.
+func (p *PostProcessor) sensitiveValues(envVars []string, scripts []ScriptConfig) []string {
+	if len(p.config.SensitiveVars) == 0 {
+		return nil
+	}
+
+	vars := append([]string(nil), envVars...)
+	for _, script := range scripts {
+		vars = append(vars, script.Vars...)
+	}
+	for _, entry := range p.config.Matrix {
+		vars = append(vars, entry.Vars...)
+	}
+
+	var values []string
+	for _, kv := range vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) == 2 && vs[1] != "" && matchesAny(vs[0], p.config.SensitiveVars) {
+			values = append(values, vs[1])
+		}
+	}
+	return values
+}
+
+// redact masks the secrets and sensitive values of the current run in s,
+// along with whatever matches sensitive_patterns.
+func (p *PostProcessor) redact(s string) string {
+	if !p.redacting {
+		return s
+	}
+
+	for _, secret := range p.secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, maskedValue, -1)
+		}
+	}
+	for _, re := range p.config.sensitivePatterns {
+		s = re.ReplaceAllLiteralString(s, maskedValue)
+	}
+	return s
+}
+
+// splitSecretVars separates the secret_vars from the rest of envVars.
+// Their values mustn't end up on a command line, where any user on the
+// machine can read them.
+func (p *PostProcessor) splitSecretVars(envVars []string) ([]string, []string) {
+	var vars, secrets []string
+	for _, kv := range envVars {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := p.config.SecretVars[name]; ok {
+			secrets = append(secrets, kv)
+		} else {
+			vars = append(vars, kv)
+		}
+	}
+	return vars, secrets
+}
+
+// readSecretVars is run by sh ahead of the command in its arguments. It
+// reads a line count, then that many lines of variable assignments, from
+// stdin, and exports them, leaving the rest of stdin to the command.
+const readSecretVars = `IFS= read -r n; s=; while [ "$n" -gt 0 ]; do IFS= read -r l; s="$s$l
+"; n=$((n - 1)); done; set -a; eval "$s"; set +a; exec "$@"`
+
+// secretVarsInput returns what readSecretVars reads to set the secret
+// variables.
+func secretVarsInput(secrets []string) io.Reader {
+	var lines []string
+	for _, kv := range secrets {
+		vs := strings.SplitN(kv, "=", 2)
+		lines = append(lines, strings.Split(vs[0]+"="+shellQuote(vs[1]), "\n")...)
+	}
+	return strings.NewReader(fmt.Sprintf("%d\n%s\n", len(lines), strings.Join(lines, "\n")))
+}
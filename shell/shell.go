@@ -0,0 +1,162 @@
+package shell
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// The kinds of shells commands can be run with, which differ in how
+// their arguments are quoted.
+const (
+	shellPosix      = "posix"
+	shellCmd        = "cmd"
+	shellPowerShell = "powershell"
+)
+
+// defaultShell returns the shell commands are run with unless configured
+// otherwise: cmd on Windows and sh everywhere else.
+func defaultShell() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd", "/C"}
+	}
+	return []string{"sh", "-c"}
+}
+
+// powerShell returns the shell use_powershell runs commands with. Windows
+// PowerShell is only on Windows, while PowerShell Core goes by pwsh.
+func powerShell() []string {
+	name := "pwsh"
+	if runtime.GOOS == "windows" {
+		name = "powershell"
+	}
+	return []string{name, "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command"}
+}
+
+// shellKind tells what kind of shell the configured one is.
+func (p *PostProcessor) shellKind() string {
+	name := strings.ToLower(filepath.Base(p.config.Shell[0]))
+	switch strings.TrimSuffix(name, ".exe") {
+	case "cmd":
+		return shellCmd
+	case "powershell", "pwsh":
+		return shellPowerShell
+	default:
+		return shellPosix
+	}
+}
+
+// defaultExecuteCommand returns the execute_command for the configured
+// shell. When batched is set, the artifact is several paths that must be
+// passed as separate arguments, so it is left unquoted.
+func (p *PostProcessor) defaultExecuteCommand(batched bool) string {
+	artifact := "{{.QuotedArtifact}}"
+	if batched {
+		artifact = "{{.Artifact}}"
+	}
+
+	// An interpreter runs the script itself, so it needn't be executable
+	if len(p.config.Interpreter) > 0 {
+		words := make([]string, len(p.config.Interpreter))
+		for i, word := range p.config.Interpreter {
+			words[i] = p.quote(word)
+		}
+		command := strings.Join(words, " ") + " {{.QuotedPath}} " + artifact + " {{.Args}}"
+		if p.shellKind() == shellPowerShell {
+			command = "& " + command
+		}
+		return command
+	}
+
+	switch p.shellKind() {
+	case shellCmd:
+		return "{{.QuotedPath}} " + artifact + " {{.Args}}"
+	case shellPowerShell:
+		return "& {{.QuotedPath}} " + artifact + " {{.Args}}"
+	default:
+		return "chmod +x {{.QuotedPath}}; {{.QuotedPath}} " + artifact + " {{.Args}}"
+	}
+}
+
+// scriptCommand returns the command running the script on its own, with
+// no artifact file or arguments, as the lifecycle scripts are run.
+func (p *PostProcessor) scriptCommand(path string) string {
+	if p.shellKind() == shellPowerShell {
+		return "& " + p.quote(path)
+	}
+	return p.quote(path)
+}
+
+// inlineExtension returns the extension the inline script needs for the
+// configured shell to run it. Windows goes by extension rather than the
+// shebang.
+func (p *PostProcessor) inlineExtension() string {
+	switch p.shellKind() {
+	case shellCmd:
+		return ".cmd"
+	case shellPowerShell:
+		return ".ps1"
+	default:
+		return ""
+	}
+}
+
+// quote quotes s so that the configured shell takes it literally.
+func (p *PostProcessor) quote(s string) string {
+	switch p.shellKind() {
+	case shellCmd:
+		return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+	case shellPowerShell:
+		return "'" + strings.Replace(s, "'", "''", -1) + "'"
+	default:
+		return shellQuote(s)
+	}
+}
+
+// shellCommand returns a command running command with the configured
+// shell.
+func (p *PostProcessor) shellCommand(ctx context.Context, command string) *exec.Cmd {
+	shell := p.config.Shell
+	args := append(shell[1:len(shell):len(shell)], command)
+	return exec.CommandContext(ctx, shell[0], args...)
+}
+
+// elevatedCommand returns a command running command with the configured
+// shell through elevate_command, as execute_as if set. The variables are
+// passed through env rather than the environment, which sudo and doas
+// don't hand on, except for the secret_vars: those are read from ahead of
+// stdin, so it returns what the command reads as stdin as well.
+func (p *PostProcessor) elevatedCommand(ctx context.Context, command string, envVars []string, stdin io.Reader) (*exec.Cmd, io.Reader) {
+	vars, secrets := p.splitSecretVars(envVars)
+	elevate := p.config.ElevateCommand
+	args := append([]string(nil), elevate[1:]...)
+	if p.config.ExecuteAs != "" {
+		args = append(args, "-u", p.config.ExecuteAs)
+	}
+	args = append(args, "env")
+	args = append(args, vars...)
+	if len(secrets) > 0 {
+		args = append(args, "sh", "-c", readSecretVars, "sh")
+		if stdin == nil {
+			stdin = secretVarsInput(secrets)
+		} else {
+			stdin = io.MultiReader(secretVarsInput(secrets), stdin)
+		}
+	}
+	args = append(args, p.config.Shell...)
+	args = append(args, command)
+	return exec.CommandContext(ctx, elevate[0], args...), stdin
+}
+
+// scriptMode returns the permissions of the scripts the post-processor
+// writes itself. With execute_as another user must be able to run them.
+func (p *PostProcessor) scriptMode() os.FileMode {
+	if p.config.ExecuteAs != "" {
+		return 0755
+	}
+	return 0700
+}
@@ -0,0 +1,16 @@
+package shell
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// isolateNetwork makes the command run in a new network namespace with
+// nothing configured in it, leaving it with no connectivity at all.
+func isolateNetwork(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func isolateNetwork(cmd *exec.Cmd) error {
+	return errors.New("network_isolation is only supported on Linux")
+}
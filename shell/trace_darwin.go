@@ -0,0 +1,9 @@
+package shell
+
+const tracer = "dtruss"
+
+// dtruss can't write its trace to a file, so it ends up in the stderr of
+// the script along with everything else.
+func tracerArgs(out string) []string {
+	return []string{"-f"}
+}
@@ -0,0 +1,10 @@
+package shell
+
+// tracer is the command trace_syscalls runs the scripts under.
+const tracer = "strace"
+
+// tracerArgs returns the arguments making the tracer follow forks and
+// write its trace to out.
+func tracerArgs(out string) []string {
+	return []string{"-f", "-o", out}
+}
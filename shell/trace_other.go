@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package shell
+
+// There is no supported tracer on this platform.
+const tracer = ""
+
+func tracerArgs(out string) []string {
+	return nil
+}
@@ -0,0 +1,95 @@
+package shell
+
+import (
+	"sync"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// bufferedUi is a packer.Ui holding back everything said through it
+// until it is flushed, so the output of concurrent runs can be shown one
+// after the other. Questions can't be held back and are asked of the
+// underlying Ui right away.
+type bufferedUi struct {
+	sync.Mutex
+	ui      packer.Ui
+	pending []func(packer.Ui)
+}
+
+func (u *bufferedUi) record(f func(packer.Ui)) {
+	u.Lock()
+	defer u.Unlock()
+	u.pending = append(u.pending, f)
+}
+
+func (u *bufferedUi) Ask(query string) (string, error) {
+	return u.ui.Ask(query)
+}
+
+func (u *bufferedUi) Say(message string) {
+	u.record(func(ui packer.Ui) { ui.Say(message) })
+}
+
+func (u *bufferedUi) Message(message string) {
+	u.record(func(ui packer.Ui) { ui.Message(message) })
+}
+
+func (u *bufferedUi) Error(message string) {
+	u.record(func(ui packer.Ui) { ui.Error(message) })
+}
+
+func (u *bufferedUi) Machine(t string, args ...string) {
+	u.record(func(ui packer.Ui) { ui.Machine(t, args...) })
+}
+
+// flush replays everything said so far to ui.
+func (u *bufferedUi) flush(ui packer.Ui) {
+	u.Lock()
+	pending := u.pending
+	u.pending = nil
+	u.Unlock()
+
+	for _, f := range pending {
+		f(ui)
+	}
+}
+
+// quietUi is a packer.Ui passing on only errors, questions and machine
+// readable output, for output_level "quiet".
+type quietUi struct {
+	packer.Ui
+}
+
+func (u *quietUi) Say(message string) {}
+
+func (u *quietUi) Message(message string) {}
+
+// redactUi is a packer.Ui masking secrets in everything said through it.
+type redactUi struct {
+	ui     packer.Ui
+	redact func(string) string
+}
+
+func (u *redactUi) Ask(query string) (string, error) {
+	return u.ui.Ask(u.redact(query))
+}
+
+func (u *redactUi) Say(message string) {
+	u.ui.Say(u.redact(message))
+}
+
+func (u *redactUi) Message(message string) {
+	u.ui.Message(u.redact(message))
+}
+
+func (u *redactUi) Error(message string) {
+	u.ui.Error(u.redact(message))
+}
+
+func (u *redactUi) Machine(t string, args ...string) {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = u.redact(arg)
+	}
+	u.ui.Machine(t, redacted...)
+}
@@ -0,0 +1,204 @@
+package shell
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// maxPooledBufferSize is the largest output buffer kept for reuse, so a
+// single script with a lot of output doesn't pin that memory for the rest
+// of the run.
+const maxPooledBufferSize = 64 * 1024
+
+// outputBuffers holds the buffers script output is collected in, reused
+// from one script run to the next instead of allocating new ones for
+// every file.
+var outputBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getOutputBuffer() *bytes.Buffer {
+	return outputBuffers.Get().(*bytes.Buffer)
+}
+
+func putOutputBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	outputBuffers.Put(b)
+}
+
+// limitedBuffer collects the output of a script in a buffer of at most
+// max bytes, no limit if zero, dropping the rest: everything after the
+// first max bytes when head is set, and everything before the last max
+// bytes otherwise.
+type limitedBuffer struct {
+	buf     *bytes.Buffer
+	max     int
+	head    bool
+	dropped int
+}
+
+func newLimitedBuffer(buf *bytes.Buffer, max int, head bool) *limitedBuffer {
+	return &limitedBuffer{buf: buf, max: max, head: head}
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	switch {
+	case l.max <= 0:
+		l.buf.Write(p)
+	case l.head:
+		n := l.max - l.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		if n > 0 {
+			l.buf.Write(p[:n])
+			l.dropped += len(p) - n
+		} else {
+			l.dropped += len(p)
+		}
+	default:
+		// Trimming only at twice the limit keeps the data from being
+		// moved on every write
+		l.buf.Write(p)
+		if l.buf.Len() > 2*l.max {
+			l.trim()
+		}
+	}
+	return len(p), nil
+}
+
+func (l *limitedBuffer) trim() {
+	if excess := l.buf.Len() - l.max; l.max > 0 && excess > 0 {
+		l.buf.Next(excess)
+		l.dropped += excess
+	}
+}
+
+// Bytes returns the output kept, marking where any was dropped.
+func (l *limitedBuffer) Bytes() []byte {
+	if !l.head {
+		l.trim()
+	}
+	if l.dropped == 0 {
+		return l.buf.Bytes()
+	}
+
+	marker := fmt.Sprintf("[%d bytes of output truncated]", l.dropped)
+	if l.head {
+		return []byte(l.buf.String() + "\n" + marker)
+	}
+	return []byte(marker + "\n" + l.buf.String())
+}
+
+func (l *limitedBuffer) String() string {
+	return string(l.Bytes())
+}
+
+// safeWriter forwards writes to a sink that may go away mid-run, such as
+// a UI whose other end has disconnected. Once the sink fails it falls
+// back to buffering instead of returning the error, since an error here
+// would abort copying the script's output and leave the script to die
+// of SIGPIPE. Whatever was buffered is logged when the writer is closed.
+type safeWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	failed bool
+	buf    bytes.Buffer
+}
+
+func newSafeWriter(w io.Writer) *safeWriter {
+	return &safeWriter{w: w}
+}
+
+func (s *safeWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.failed {
+		_, err := s.w.Write(p)
+		if err == nil {
+			return len(p), nil
+		}
+
+		log.Printf("Error writing script output, buffering the rest: %s", err)
+		s.failed = true
+	}
+
+	s.buf.Write(p)
+	return len(p), nil
+}
+
+// Close logs anything that was buffered after the sink failed.
+func (s *safeWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buf.Len() > 0 {
+		log.Printf("Buffered script output: %s", s.buf.String())
+		s.buf.Reset()
+	}
+	return nil
+}
+
+// uiWriter sends everything written to it to the UI line by line as it
+// arrives, so that the output of long running scripts shows up while
+// they run instead of once they're done.
+type uiWriter struct {
+	mu   sync.Mutex
+	say  func(string)
+	line bytes.Buffer
+}
+
+func newUiWriter(say func(string)) *uiWriter {
+	return &uiWriter{say: say}
+}
+
+func (u *uiWriter) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, b := range p {
+		if b != '\n' {
+			u.line.WriteByte(b)
+			continue
+		}
+
+		u.say(strings.TrimRight(u.line.String(), "\r"))
+		u.line.Reset()
+	}
+
+	return len(p), nil
+}
+
+// Flush sends what's left of a last line without a newline.
+func (u *uiWriter) Flush() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.line.Len() > 0 {
+		u.say(strings.TrimRight(u.line.String(), "\r"))
+		u.line.Reset()
+	}
+}
+
+// redactWriter masks secrets in everything written to it before passing
+// it on. Secrets split across writes aren't masked, so it suits writers
+// written a whole message at a time, like the log.
+type redactWriter struct {
+	w      io.Writer
+	redact func(string) string
+}
+
+func (r *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
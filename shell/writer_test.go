@@ -0,0 +1,53 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingWriter fails every write once it has taken limit bytes.
+type failingWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.limit {
+		return 0, errors.New("broken pipe")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestSafeWriter(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	sink := &failingWriter{limit: 6}
+	w := newSafeWriter(sink)
+	for _, s := range []string{"first\n", "second\n", "third\n"} {
+		n, err := w.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("bad: %d %s", n, err)
+		}
+	}
+
+	if sink.String() != "first\n" {
+		t.Fatalf("bad: %q", sink.String())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := logged.String()
+	if !strings.Contains(out, "Error writing script output, buffering the rest: broken pipe") {
+		t.Fatalf("bad: %s", out)
+	}
+	if !strings.Contains(out, "Buffered script output: second\nthird\n") {
+		t.Fatalf("bad: %s", out)
+	}
+}